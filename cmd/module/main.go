@@ -2,6 +2,8 @@
 package main
 
 import (
+	"go.viam.com/rdk/components/camera"
+	"go.viam.com/rdk/components/sensor"
 	"go.viam.com/rdk/module"
 	"go.viam.com/rdk/resource"
 	"go.viam.com/rdk/services/vision"
@@ -12,5 +14,7 @@ import (
 func main() {
 	module.ModularMain(
 		resource.APIModel{API: vision.API, Model: triangle_on_sonar_finder.Model},
+		resource.APIModel{API: camera.API, Model: triangle_on_sonar_finder.OverlayModel},
+		resource.APIModel{API: sensor.API, Model: triangle_on_sonar_finder.SensorModel},
 	)
 }
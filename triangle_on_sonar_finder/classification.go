@@ -0,0 +1,46 @@
+package triangle_on_sonar_finder
+
+import (
+	"sort"
+
+	"go.viam.com/rdk/vision/classification"
+)
+
+// noTriangleLabel is the class returned when no template matches above the threshold.
+const noTriangleLabel = "no_triangle"
+
+// classifyMatches returns, for the n labels with the best detections (all of them if n <= 0), the best score
+// of their detections. Without detections, it returns the single no_triangle class, scored 1 minus the best
+// correlation of the frame so a frame that nearly matched is a less confident no_triangle.
+func classifyMatches(matches []Match, bestCorrelation float32, n int) classification.Classifications {
+	best := map[string]float32{}
+	for _, match := range matches {
+		if score, ok := best[match.Label]; !ok || match.Score > score {
+			best[match.Label] = match.Score
+		}
+	}
+	if len(best) == 0 {
+		score := 1 - min(max(float64(bestCorrelation), 0), 1)
+		return classification.Classifications{classification.NewClassification(score, noTriangleLabel)}
+	}
+
+	labels := make([]string, 0, len(best))
+	for label := range best {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if best[labels[i]] != best[labels[j]] {
+			return best[labels[i]] > best[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	if n > 0 && n < len(labels) {
+		labels = labels[:n]
+	}
+
+	classifications := make(classification.Classifications, 0, len(labels))
+	for _, label := range labels {
+		classifications = append(classifications, classification.NewClassification(float64(best[label]), label))
+	}
+	return classifications
+}
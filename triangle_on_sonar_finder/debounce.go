@@ -0,0 +1,98 @@
+package triangle_on_sonar_finder
+
+import (
+	"image"
+	"math"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// maxConfirmWindowFrames is the longest window detections can be counted over, the bits of a track history.
+const maxConfirmWindowFrames = 64
+
+// debounceOptions controls which tracks are returned: a track is confirmed once its triangle was detected in
+// confirmFrames of the last windowFrames frames, and a confirmed track is returned until it has been missed
+// for more than holdFrames frames.
+type debounceOptions struct {
+	confirmFrames int
+	windowFrames  int
+	holdFrames    int
+}
+
+// confirms returns true if a track with the given detection history is confirmed.
+func (opts *debounceOptions) confirms(history uint64) bool {
+	window := history
+	if opts.windowFrames < maxConfirmWindowFrames {
+		window &= 1<<opts.windowFrames - 1
+	}
+	return bits.OnesCount64(window) >= opts.confirmFrames
+}
+
+// debounceOptions returns the debouncing options of the config, nil if debouncing is disabled.
+func (cfg *TriangleFinderConfig) debounceOptions() *debounceOptions {
+	if cfg.ConfirmFrames <= 1 && cfg.HoldFrames == 0 {
+		return nil
+	}
+	opts := &debounceOptions{
+		confirmFrames: max(cfg.ConfirmFrames, 1),
+		windowFrames:  cfg.ConfirmWindowFrames,
+		holdFrames:    cfg.HoldFrames,
+	}
+	if opts.windowFrames == 0 {
+		opts.windowFrames = opts.confirmFrames
+	}
+	return opts
+}
+
+func (cfg TriangleFinderConfig) validateDebouncing() error {
+	if cfg.ConfirmFrames < 0 || cfg.ConfirmWindowFrames < 0 || cfg.HoldFrames < 0 {
+		return errors.New("confirm_frames, confirm_window_frames and hold_frames must not be negative")
+	}
+	if (cfg.ConfirmFrames != 0 || cfg.ConfirmWindowFrames != 0 || cfg.HoldFrames != 0) && !cfg.Tracking {
+		return errors.New("confirm_frames, confirm_window_frames and hold_frames require tracking")
+	}
+	if cfg.ConfirmWindowFrames > maxConfirmWindowFrames {
+		return errors.Errorf("confirm_window_frames must be at most %d, got %d",
+			maxConfirmWindowFrames, cfg.ConfirmWindowFrames)
+	}
+	if cfg.ConfirmWindowFrames != 0 && cfg.ConfirmWindowFrames < cfg.ConfirmFrames {
+		return errors.Errorf("confirm_window_frames (%d) must not be less than confirm_frames (%d)",
+			cfg.ConfirmWindowFrames, cfg.ConfirmFrames)
+	}
+	return nil
+}
+
+// debounced returns the matches of the confirmed tracks, followed by the confirmed tracks missed in this frame
+// for at most holdFrames frames, with the id of the track of each. Held tracks are reported with their last
+// score, at the position predicted by their motion filter or else at their last detected position.
+func (tr *tracker) debounced(matches []Match, assigned []*track) ([]Match, []int) {
+	var reported []Match
+	var ids []int
+	for m, t := range assigned {
+		if t.confirmed {
+			reported = append(reported, matches[m])
+			ids = append(ids, t.id)
+		}
+	}
+	for _, t := range tr.tracks {
+		if !t.confirmed || t.missed == 0 || t.missed > tr.opts.debounce.holdFrames {
+			continue
+		}
+		box := t.box
+		if t.filter != nil {
+			x, y := t.center()
+			box = box.Add(image.Pt(int(math.Round(t.filter.x.pos-x)), int(math.Round(t.filter.y.pos-y))))
+		}
+		reported = append(reported, Match{
+			X:      box.Min.X,
+			Y:      box.Min.Y,
+			Width:  box.Dx(),
+			Height: box.Dy(),
+			Score:  t.score,
+			Label:  t.label,
+		})
+		ids = append(ids, t.id)
+	}
+	return reported, ids
+}
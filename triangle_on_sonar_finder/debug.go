@@ -0,0 +1,47 @@
+package triangle_on_sonar_finder
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// debugImage returns the current frame of a camera with the bounding box and score of each detection drawn on it,
+// and with "edges" the edge matrix the templates were matched against, so false positives can be looked into remotely.
+func (tf *myTriangleFinder) debugImage(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	cameraName, err := cameraNameParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	withEdges, err := boolParam(cmd, "edges")
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := tf.imageFromCamera(ctx, cameraName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get image from camera")
+	}
+	search, err := tf.search(ctx, frame)
+	if err != nil {
+		return nil, err
+	}
+	matches, edges := search.matches, search.edges
+
+	encoded, err := encodeBase64PNG(drawDetections(frame, matchesToDetections(matches)))
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{
+		"image":      encoded,
+		"mime_type":  "image/png",
+		"detections": len(matches),
+	}
+	if withEdges && len(edges) > 0 {
+		if res["edges"], err = encodeBase64PNG(EdgeMatrixToGrayImage(edges)); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
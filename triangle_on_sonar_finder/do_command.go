@@ -0,0 +1,280 @@
+package triangle_on_sonar_finder
+
+import (
+	"context"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	commandKey = "command"
+
+	// getScaleStatsCommand reports how many detections were made by templates of each scale.
+	getScaleStatsCommand = "get_scale_stats"
+	// getConfigCommand reports the settings currently used for detection, defaults included.
+	getConfigCommand = "get_config"
+	// setParamsCommand changes detection settings at runtime, for example
+	// {"command": "set_params", "threshold": 0.7, "stride": 1}.
+	setParamsCommand = "set_params"
+	// uploadTemplateCommand adds a template from a base64 encoded png or jpeg image, for example
+	// {"command": "upload_template", "image": "iVBORw0...", "label": "triangle", "crop": {"x": 10, "y": 10, "width": 40, "height": 40}}.
+	uploadTemplateCommand = "upload_template"
+	// templateFromCameraCommand adds a template cropped from the current frame of a camera and returns a preview
+	// of its edges, for example {"command": "template_from_camera", "crop": {"x": 10, "y": 10, "width": 40, "height": 40}}.
+	templateFromCameraCommand = "template_from_camera"
+	// debugImageCommand returns the current frame of a camera with the detections drawn on it, and optionally
+	// its edges, for example {"command": "debug_image", "camera_name": "camera-1", "edges": true}.
+	debugImageCommand = "debug_image"
+	// correlationHeatmapCommand returns the best template correlation at each position of the current frame of a
+	// camera as a heatmap image, with a histogram of the correlations, for example {"command": "correlation_heatmap", "bins": 10}.
+	correlationHeatmapCommand = "correlation_heatmap"
+	// getLatestDetectionsCommand returns the latest detections of a camera with the time its frame was captured,
+	// for example {"command": "get_latest_detections", "camera_name": "camera-1"}.
+	getLatestDetectionsCommand = "get_latest_detections"
+	// getSonarCalibrationCommand returns the sonar calibration of a camera, if it has one,
+	// for example {"command": "get_sonar_calibration", "camera_name": "camera-1"}.
+	getSonarCalibrationCommand = "get_sonar_calibration"
+	// getTracksCommand returns the triangles currently tracked on a camera, when tracking is enabled,
+	// for example {"command": "get_tracks", "camera_name": "camera-1"}.
+	getTracksCommand = "get_tracks"
+	// listTemplatesCommand lists the templates currently matched, with their size at each scale.
+	listTemplatesCommand = "list_templates"
+	// deleteTemplateCommand removes the template with the given id, for example {"command": "delete_template", "id": "triangle_1.png"}.
+	deleteTemplateCommand = "delete_template"
+)
+
+// DoCommand runs the command named by the "command" key of cmd.
+func (tf *myTriangleFinder) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	name, ok := cmd[commandKey].(string)
+	if !ok {
+		return nil, errors.Errorf("expected a %q string in the command, got %v", commandKey, cmd[commandKey])
+	}
+
+	switch name {
+	case getScaleStatsCommand:
+		return tf.scaleStats(), nil
+	case getConfigCommand:
+		return tf.effectiveConfig(), nil
+	case setParamsCommand:
+		return tf.setParams(cmd)
+	case uploadTemplateCommand:
+		return tf.uploadTemplate(cmd)
+	case templateFromCameraCommand:
+		return tf.templateFromCamera(ctx, cmd)
+	case debugImageCommand:
+		return tf.debugImage(ctx, cmd)
+	case correlationHeatmapCommand:
+		return tf.correlationHeatmap(ctx, cmd)
+	case getLatestDetectionsCommand:
+		return tf.latestDetections(ctx, cmd)
+	case getSonarCalibrationCommand:
+		return tf.sonarCalibration(cmd)
+	case getTracksCommand:
+		return tf.tracks(cmd)
+	case listTemplatesCommand:
+		return tf.listTemplates(), nil
+	case deleteTemplateCommand:
+		return tf.deleteTemplate(cmd)
+	default:
+		return nil, errors.Errorf("unknown command %q", name)
+	}
+}
+
+// scaleStats returns the number of detections made at each template scale since the service started,
+// so operators can see which display zoom levels actually occur.
+func (tf *myTriangleFinder) scaleStats() map[string]interface{} {
+	tf.mu.RLock()
+	scale := tf.opts.scale
+	tf.mu.RUnlock()
+
+	tf.statsMu.Lock()
+	defer tf.statsMu.Unlock()
+
+	factors := make([]float64, 0, len(tf.scaleCounts))
+	for factor := range tf.scaleCounts {
+		factors = append(factors, factor)
+	}
+	sort.Float64s(factors)
+
+	scales := make([]interface{}, 0, len(factors))
+	for _, factor := range factors {
+		scales = append(scales, map[string]interface{}{
+			"scale_factor":   factor,
+			"template_scale": factor * scale,
+			"detections":     tf.scaleCounts[factor],
+		})
+	}
+	return map[string]interface{}{
+		"frames": tf.frames,
+		"scales": scales,
+	}
+}
+
+// effectiveConfig returns the settings currently used for detection.
+func (tf *myTriangleFinder) effectiveConfig() map[string]interface{} {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
+	scaleFactors := tf.config.templateScaleFactors()
+	if scaleFactors == nil {
+		scaleFactors = defaultScaleFactors
+	}
+	nmsIoU := tf.opts.nmsIoU
+	if nmsIoU <= 0 {
+		nmsIoU = defaultNMSIoU
+	}
+	return map[string]interface{}{
+		"camera_names":        tf.config.cameraNames(),
+		"threshold":           float64(tf.opts.threshold),
+		"scale":               tf.opts.scale,
+		"stride":              tf.opts.stride,
+		"nms_iou_threshold":   nmsIoU,
+		"edge_threshold":      tf.opts.edgeThreshold,
+		"correlation_backend": string(tf.opts.backend),
+		"search_mode":         string(tf.opts.mode),
+		"num_workers":         tf.opts.workers,
+		"template_scales":     scaleFactors,
+		"templates":           len(tf.templates),
+	}
+}
+
+// setParams updates the threshold, scale, stride, NMS IoU and edge threshold used for detection. The templates
+// are only rebuilt when the scale or the edge threshold actually change, while the cached results and the tracks
+// found with the previous settings are always dropped.
+func (tf *myTriangleFinder) setParams(cmd map[string]interface{}) (map[string]interface{}, error) {
+	tf.updateMu.Lock()
+	defer tf.updateMu.Unlock()
+
+	tf.mu.RLock()
+	oldConf := tf.config
+	newConf := *oldConf
+	templates := tf.templates
+	tf.mu.RUnlock()
+
+	for key, value := range cmd {
+		var err error
+		switch key {
+		case commandKey:
+		case "threshold":
+			var threshold float64
+			threshold, err = numberParam(key, value)
+			newConf.Threshold = float32(threshold)
+		case "scale":
+			newConf.Scale, err = numberParam(key, value)
+		case "stride":
+			newConf.Stride, err = intParam(key, value)
+		case "nms_iou_threshold":
+			newConf.NMSIoU, err = numberParam(key, value)
+		case "edge_threshold":
+			newConf.EdgeThreshold, err = intParam(key, value)
+		default:
+			err = errors.Errorf("unknown parameter %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := newConf.Validate(tf.name.String()); err != nil {
+		return nil, err
+	}
+	opts, err := newMatchOptions(&newConf)
+	if err != nil {
+		return nil, err
+	}
+
+	rebuilt := templatesChanged(oldConf, &newConf)
+	if rebuilt {
+		templates, err = buildTemplates(&newConf, tf.uploaded, tf.removed, tf.logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to rebuild templates")
+		}
+	}
+
+	tf.mu.Lock()
+	tf.config, tf.opts, tf.templates = &newConf, opts, templates
+	tf.mu.Unlock()
+	tf.resetResults(&newConf)
+
+	res := tf.effectiveConfig()
+	res["templates_rebuilt"] = rebuilt
+	return res, nil
+}
+
+// numberParam returns a numeric DoCommand parameter, numbers arrive as float64 from JSON and protobuf.
+func numberParam(key string, value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	default:
+		return 0, errors.Errorf("%s must be a number, got %v", key, value)
+	}
+}
+
+// stringParam returns a string DoCommand parameter.
+func stringParam(key string, value interface{}) (string, error) {
+	v, ok := value.(string)
+	if !ok {
+		return "", errors.Errorf("%s must be a string, got %v", key, value)
+	}
+	return v, nil
+}
+
+// cameraNameParam returns the "camera_name" parameter of a command, empty for the default camera if not set.
+func cameraNameParam(cmd map[string]interface{}) (string, error) {
+	value, ok := cmd["camera_name"]
+	if !ok {
+		return "", nil
+	}
+	return stringParam("camera_name", value)
+}
+
+// boolParam returns an optional boolean DoCommand parameter, false if not set.
+func boolParam(cmd map[string]interface{}, key string) (bool, error) {
+	value, ok := cmd[key]
+	if !ok {
+		return false, nil
+	}
+	v, ok := value.(bool)
+	if !ok {
+		return false, errors.Errorf("%s must be a boolean, got %v", key, value)
+	}
+	return v, nil
+}
+
+// rectParam returns a rectangle DoCommand parameter given as {"x": 0, "y": 0, "width": 10, "height": 10}.
+func rectParam(key string, value interface{}) (image.Rectangle, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return image.Rectangle{}, errors.Errorf("%s must be an object with x, y, width and height, got %v", key, value)
+	}
+	var x, y, width, height int
+	for name, dst := range map[string]*int{"x": &x, "y": &y, "width": &width, "height": &height} {
+		v, err := intParam(key+"."+name, fields[name])
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		*dst = v
+	}
+	if width <= 0 || height <= 0 {
+		return image.Rectangle{}, errors.Errorf("%s must have a positive width and height, got %dx%d", key, width, height)
+	}
+	return image.Rect(x, y, x+width, y+height), nil
+}
+
+// intParam returns a whole number DoCommand parameter.
+func intParam(key string, value interface{}) (int, error) {
+	v, err := numberParam(key, value)
+	if err != nil {
+		return 0, err
+	}
+	if v != math.Trunc(v) {
+		return 0, errors.Errorf("%s must be a whole number, got %v", key, v)
+	}
+	return int(v), nil
+}
@@ -0,0 +1,62 @@
+package triangle_on_sonar_finder
+
+import "sync"
+
+// edgeFrame is an edge matrix prepared for template matching. It holds summed-area tables of the
+// matrix and of its square so the mean and variance of any window can be computed in O(1).
+// It is built once per frame and shared by every template.
+type edgeFrame struct {
+	data   [][]float64
+	width  int
+	height int
+	sum    [][]float64 // sum[y][x] is the sum of data over [0,y) x [0,x)
+	sqSum  [][]float64 // sqSum[y][x] is the sum of data squared over [0,y) x [0,x)
+
+	// spectrum of the frame, only computed when a template is matched with the FFT backend
+	spectrumOnce sync.Once
+	fftWidth     int
+	fftHeight    int
+	fftData      []complex128
+}
+
+// newEdgeFrame computes the summed-area tables of an edge matrix.
+func newEdgeFrame(data [][]float64) *edgeFrame {
+	height := len(data)
+	width := 0
+	if height > 0 {
+		width = len(data[0])
+	}
+
+	sum := make([][]float64, height+1)
+	sqSum := make([][]float64, height+1)
+	for y := range sum {
+		sum[y] = make([]float64, width+1)
+		sqSum[y] = make([]float64, width+1)
+	}
+
+	for y := 0; y < height; y++ {
+		var rowSum, rowSqSum float64
+		for x := 0; x < width; x++ {
+			v := data[y][x]
+			rowSum += v
+			rowSqSum += v * v
+			sum[y+1][x+1] = sum[y][x+1] + rowSum
+			sqSum[y+1][x+1] = sqSum[y][x+1] + rowSqSum
+		}
+	}
+
+	return &edgeFrame{
+		data:   data,
+		width:  width,
+		height: height,
+		sum:    sum,
+		sqSum:  sqSum,
+	}
+}
+
+// windowSums returns the sum and the sum of squares of the w x h window whose top left corner is (x, y).
+func (f *edgeFrame) windowSums(x, y, w, h int) (float64, float64) {
+	sum := f.sum[y+h][x+w] - f.sum[y][x+w] - f.sum[y+h][x] + f.sum[y][x]
+	sqSum := f.sqSum[y+h][x+w] - f.sqSum[y][x+w] - f.sqSum[y+h][x] + f.sqSum[y][x]
+	return sum, sqSum
+}
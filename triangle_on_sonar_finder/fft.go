@@ -0,0 +1,157 @@
+package triangle_on_sonar_finder
+
+import (
+	"fmt"
+	"math/cmplx"
+
+	"gonum.org/v1/gonum/dsp/fourier"
+)
+
+// correlationBackend selects how the numerator of the correlation, sum(crop * kernel), is computed.
+type correlationBackend string
+
+const (
+	// backendAuto uses the FFT for templates of at least fftMinKernelArea pixels and the spatial sum otherwise.
+	backendAuto correlationBackend = "auto"
+	// backendSpatial computes the sum directly for each window.
+	backendSpatial correlationBackend = "spatial"
+	// backendFFT computes the whole correlation surface of a template at once in the frequency domain.
+	backendFFT correlationBackend = "fft"
+)
+
+// fftMinKernelArea is the template size (in pixels, after padding) from which the auto backend uses the FFT.
+// Below it the direct sum over the kernel is faster than the three transforms per template.
+const fftMinKernelArea = 1024
+
+// parseCorrelationBackend returns the backend named in the config, auto if empty.
+func parseCorrelationBackend(name string) (correlationBackend, error) {
+	switch backend := correlationBackend(name); backend {
+	case "":
+		return backendAuto, nil
+	case backendAuto, backendSpatial, backendFFT:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown correlation_backend %q, expected one of %q, %q or %q", name, backendAuto, backendSpatial, backendFFT)
+	}
+}
+
+// useFFT returns true if the template should be matched in the frequency domain.
+func (b correlationBackend) useFFT(t *TemplateFromImage) bool {
+	switch b {
+	case backendFFT:
+		return true
+	case backendSpatial:
+		return false
+	default:
+		return t.kernelWidth*t.kernelHeight >= fftMinKernelArea
+	}
+}
+
+// fft2D is an unnormalized 2D FFT of row-major data, built from 1D transforms of the rows and columns.
+// It keeps work buffers so it must not be shared between goroutines.
+type fft2D struct {
+	width  int
+	height int
+	rows   *fourier.CmplxFFT
+	cols   *fourier.CmplxFFT
+	column []complex128
+}
+
+func newFFT2D(width, height int) *fft2D {
+	return &fft2D{
+		width:  width,
+		height: height,
+		rows:   fourier.NewCmplxFFT(width),
+		cols:   fourier.NewCmplxFFT(height),
+		column: make([]complex128, height),
+	}
+}
+
+// forward transforms data in place.
+func (f *fft2D) forward(data []complex128) {
+	f.transform(data, f.rows.Coefficients, f.cols.Coefficients)
+}
+
+// inverse transforms data in place, including the 1/(width*height) normalization.
+func (f *fft2D) inverse(data []complex128) {
+	f.transform(data, f.rows.Sequence, f.cols.Sequence)
+	norm := complex(1/float64(f.width*f.height), 0)
+	for i := range data {
+		data[i] *= norm
+	}
+}
+
+func (f *fft2D) transform(data []complex128, rowFn, colFn func(dst, seq []complex128) []complex128) {
+	for y := 0; y < f.height; y++ {
+		row := data[y*f.width : (y+1)*f.width]
+		rowFn(row, row)
+	}
+	for x := 0; x < f.width; x++ {
+		for y := 0; y < f.height; y++ {
+			f.column[y] = data[y*f.width+x]
+		}
+		colFn(f.column, f.column)
+		for y := 0; y < f.height; y++ {
+			data[y*f.width+x] = f.column[y]
+		}
+	}
+}
+
+// fftSize returns the smallest length >= n that only has 2, 3 and 5 as prime factors, which the FFT handles efficiently.
+func fftSize(n int) int {
+	for size := n; ; size++ {
+		m := size
+		for _, p := range []int{2, 3, 5} {
+			for m%p == 0 {
+				m /= p
+			}
+		}
+		if m == 1 {
+			return size
+		}
+	}
+}
+
+// crossCorrelate returns the surface sum(crop * kernel) for every window position of the template in the frame.
+// The value for the window whose top left corner is (x, y) is at index y*frame.fftWidth + x. Windows that do
+// not fit in the frame wrap around and must be ignored.
+func (f *edgeFrame) crossCorrelate(t *TemplateFromImage) []float64 {
+	spectrum := f.spectrum()
+
+	fft := newFFT2D(f.fftWidth, f.fftHeight)
+	kernel := make([]complex128, f.fftWidth*f.fftHeight)
+	for y := 0; y < t.kernelHeight; y++ {
+		for x := 0; x < t.kernelWidth; x++ {
+			kernel[y*f.fftWidth+x] = complex(t.kernel[y][x], 0)
+		}
+	}
+	fft.forward(kernel)
+
+	// correlation is the product with the conjugate of the kernel spectrum
+	for i := range kernel {
+		kernel[i] = spectrum[i] * cmplx.Conj(kernel[i])
+	}
+	fft.inverse(kernel)
+
+	surface := make([]float64, len(kernel))
+	for i, v := range kernel {
+		surface[i] = real(v)
+	}
+	return surface
+}
+
+// spectrum returns the FFT of the frame, computing it on first use.
+func (f *edgeFrame) spectrum() []complex128 {
+	f.spectrumOnce.Do(func() {
+		f.fftWidth = fftSize(f.width)
+		f.fftHeight = fftSize(f.height)
+		f.fftData = make([]complex128, f.fftWidth*f.fftHeight)
+		for y := 0; y < f.height; y++ {
+			for x := 0; x < f.width; x++ {
+				f.fftData[y*f.fftWidth+x] = complex(f.data[y][x], 0)
+			}
+		}
+		newFFT2D(f.fftWidth, f.fftHeight).forward(f.fftData)
+	})
+	return f.fftData
+}
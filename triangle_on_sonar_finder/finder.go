@@ -2,8 +2,12 @@ package triangle_on_sonar_finder
 
 import (
 	"context"
-
 	"image"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.viam.com/rdk/components/camera"
@@ -34,58 +38,531 @@ func init() {
 // TriangleFinderConfig contains the configuration for the triangle finder.
 type TriangleFinderConfig struct {
 	// Camera is the name of the camera to use for triangle detection.
-	Camera string `json:"camera_name"`
+	Camera string `json:"camera_name,omitempty"`
+
+	// Cameras are the names of additional cameras, selected by the camera name of each request.
+	// The default camera is Camera if set, else the first one of Cameras.
+	Cameras []string `json:"camera_names,omitempty"`
 
 	// Threshold is the matching threshold value used for template matching.
 	Threshold float32 `json:"threshold,omitempty"`
 
 	// Scale is the resizing scale factor for input images (while maintaining aspect ratio)
 	Scale float64 `json:"scale,omitempty"`
+
+	// TemplatesDirectory is a directory on disk to load template images from instead of the embedded templates.
+	TemplatesDirectory string `json:"path_to_templates_directory,omitempty"`
+
+	// MergeEmbeddedTemplates also loads the embedded templates when TemplatesDirectory is set.
+	MergeEmbeddedTemplates bool `json:"merge_embedded_templates,omitempty"`
+
+	// TemplateLabels maps a template id, its file name relative to its templates directory, to the label reported
+	// for its detections. Embedded templates merged with a directory have ids starting with "embedded/".
+	// Templates that are not listed are labelled after their subdirectory or file name.
+	TemplateLabels map[string]string `json:"template_labels,omitempty"`
+
+	// UploadedTemplatesDirectory is a directory templates uploaded with the upload_template command are saved to,
+	// they are loaded from it again when the service starts. Uploaded templates are only kept in memory if not set.
+	UploadedTemplatesDirectory string `json:"uploaded_templates_directory,omitempty"`
+
+	// CorrelationBackend is how templates are correlated with the image: "spatial", "fft" or "auto" (default),
+	// which uses the FFT for large templates.
+	CorrelationBackend string `json:"correlation_backend,omitempty"`
+
+	// NumWorkers is the number of templates (or bands of image rows) matched concurrently, GOMAXPROCS if 0.
+	NumWorkers int `json:"num_workers,omitempty"`
+
+	// SearchMode is "exhaustive" (default) to match every window of the image, or "pyramid" to find candidates
+	// on a downsampled image and only search their neighborhoods at full resolution.
+	SearchMode string `json:"search_mode,omitempty"`
+
+	// PyramidLevels is the number of times the image is halved for the coarse pass of the pyramid search.
+	PyramidLevels int `json:"pyramid_levels,omitempty"`
+
+	// PyramidCandidateThreshold is the coarse correlation a window needs to be refined by the pyramid search.
+	PyramidCandidateThreshold float32 `json:"pyramid_candidate_threshold,omitempty"`
+
+	// TemplateScales are the sizes, relative to Scale, at which a copy of each template is matched.
+	// Defaults to 0.75, 1 and 1.25. Mutually exclusive with the TemplateScaleMin/Max/Steps range.
+	TemplateScales []float64 `json:"template_scales,omitempty"`
+
+	// TemplateScaleMin, TemplateScaleMax and TemplateScaleSteps define evenly spaced template scales
+	// from min to max (inclusive), 3 steps if TemplateScaleSteps is not set.
+	TemplateScaleMin   float64 `json:"template_scale_min,omitempty"`
+	TemplateScaleMax   float64 `json:"template_scale_max,omitempty"`
+	TemplateScaleSteps int     `json:"template_scale_steps,omitempty"`
+
+	// Stride is the step in pixels between the windows compared with the templates, 2 if not set.
+	Stride int `json:"stride,omitempty"`
+
+	// NMSIoU is the overlap above which the weaker of two detections of the same label is dropped, 0.3 if not set.
+	NMSIoU float64 `json:"nms_iou_threshold,omitempty"`
+
+	// EdgeThreshold is the Sobel gradient magnitude below which edges are dropped from the images
+	// and the templates, 50 if not set.
+	EdgeThreshold int `json:"edge_threshold,omitempty"`
+
+	// PollRateHz is how many times per second each camera is searched in the background, requests for a camera
+	// then return its latest result. Cameras are only searched on request if 0.
+	PollRateHz float64 `json:"poll_rate_hz,omitempty"`
+
+	// MaxResultAgeMs is how old, in milliseconds, the latest result of a camera can be and still be returned,
+	// 3 polls (or 3 times the search time without polling) if not set. Older results are replaced by a new search.
+	MaxResultAgeMs int `json:"max_result_age_ms,omitempty"`
+
+	// Tracking associates the detections of successive frames of each camera, so each triangle keeps the same
+	// track id for as long as it is followed. Tracks are returned by the get_tracks command.
+	Tracking bool `json:"tracking,omitempty"`
+
+	// TrackIDsInLabels appends the track id to the label of each detection, as in "triangle#3".
+	TrackIDsInLabels bool `json:"track_ids_in_labels,omitempty"`
+
+	// TrackMaxDistance is the largest distance, in image pixels, a triangle can move between two frames and
+	// keep its track. Defaults to the size of the triangle.
+	TrackMaxDistance float64 `json:"track_max_distance,omitempty"`
+
+	// TrackMaxMissedFrames is the number of frames a track is kept after its triangle was last detected, 5 if not set.
+	TrackMaxMissedFrames int `json:"track_max_missed_frames,omitempty"`
+
+	// KalmanFilter smooths the position of each track with a constant velocity Kalman filter, which also
+	// estimates its velocity and heading.
+	KalmanFilter bool `json:"kalman_filter,omitempty"`
+
+	// KalmanProcessNoise is how much tracks are expected to accelerate, in px²/s³, 100 if not set.
+	// Higher values follow changes of course faster but smooth less.
+	KalmanProcessNoise float64 `json:"kalman_process_noise,omitempty"`
+
+	// KalmanMeasurementNoise is the variance of the detected positions, in px², 4 if not set.
+	KalmanMeasurementNoise float64 `json:"kalman_measurement_noise,omitempty"`
+
+	// ConfirmFrames is the number of frames, out of the last ConfirmWindowFrames, a track must be detected in
+	// before its detections are returned, which suppresses one frame false positives. Every detection is
+	// returned if not set.
+	ConfirmFrames int `json:"confirm_frames,omitempty"`
+
+	// ConfirmWindowFrames is the number of consecutive frames ConfirmFrames are counted over, ConfirmFrames
+	// if not set, at most 64.
+	ConfirmWindowFrames int `json:"confirm_window_frames,omitempty"`
+
+	// HoldFrames is the number of frames a confirmed track is still returned after its triangle was last
+	// detected, at its last position or at the position predicted by the Kalman filter.
+	HoldFrames int `json:"hold_frames,omitempty"`
+
+	// SonarCalibrations locate the sonar fan in the images of each camera, by camera name, so their detections
+	// are also reported as a range and bearing from the transducer. Cameras without an entry are not calibrated.
+	SonarCalibrations map[string]*SonarCalibration `json:"sonar_calibrations,omitempty"`
+}
+
+func (cfg TriangleFinderConfig) validateTemplateScales() error {
+	hasRange := cfg.TemplateScaleMin != 0 || cfg.TemplateScaleMax != 0 || cfg.TemplateScaleSteps != 0
+	if len(cfg.TemplateScales) > 0 && hasRange {
+		return errors.New("template_scales cannot be used with template_scale_min, template_scale_max or template_scale_steps")
+	}
+	for _, factor := range cfg.TemplateScales {
+		if factor <= 0 {
+			return errors.Errorf("template_scales must be positive, got %v", factor)
+		}
+	}
+	if !hasRange {
+		return nil
+	}
+	if cfg.TemplateScaleMin <= 0 || cfg.TemplateScaleMax <= 0 {
+		return errors.New("template_scale_min and template_scale_max must both be set and positive")
+	}
+	if cfg.TemplateScaleMin > cfg.TemplateScaleMax {
+		return errors.Errorf("template_scale_min (%v) must not be greater than template_scale_max (%v)",
+			cfg.TemplateScaleMin, cfg.TemplateScaleMax)
+	}
+	if cfg.TemplateScaleSteps < 0 {
+		return errors.Errorf("template_scale_steps must not be negative, got %d", cfg.TemplateScaleSteps)
+	}
+	return nil
 }
 
-// TODO: implement Validate
+// templateScaleFactors returns the configured template scales, nil for the defaults.
+func (cfg *TriangleFinderConfig) templateScaleFactors() []float64 {
+	if len(cfg.TemplateScales) > 0 {
+		return cfg.TemplateScales
+	}
+	if cfg.TemplateScaleMin == 0 && cfg.TemplateScaleMax == 0 {
+		return nil
+	}
+	steps := cfg.TemplateScaleSteps
+	if steps == 0 {
+		steps = 3
+	}
+	if steps == 1 {
+		return []float64{cfg.TemplateScaleMin}
+	}
+	factors := make([]float64, steps)
+	for i := range factors {
+		factors[i] = cfg.TemplateScaleMin + float64(i)*(cfg.TemplateScaleMax-cfg.TemplateScaleMin)/float64(steps-1)
+	}
+	return factors
+}
+
+// templateSources returns the sources templates should be loaded from, in order.
+func (cfg *TriangleFinderConfig) templateSources() []templateSource {
+	if cfg.TemplatesDirectory == "" {
+		return []templateSource{embeddedTemplateSource()}
+	}
+	sources := []templateSource{directoryTemplateSource(cfg.TemplatesDirectory)}
+	if cfg.MergeEmbeddedTemplates {
+		sources = append(sources, &prefixedTemplateSource{templateSource: embeddedTemplateSource(), prefix: embeddedPrefix})
+	}
+	return sources
+}
+
+// Validate checks the config and returns the cameras as dependencies.
 func (cfg TriangleFinderConfig) Validate(path string) ([]string, error) {
-	return []string{cfg.Camera}, nil
+	if cfg.Camera == "" && len(cfg.Cameras) == 0 {
+		return nil, resource.NewConfigValidationFieldRequiredError(path, "camera_name")
+	}
+	seen := map[string]bool{}
+	for _, name := range cfg.cameraNames() {
+		if name == "" {
+			return nil, resource.NewConfigValidationError(path, errors.New("camera_names must not contain empty names"))
+		}
+		if seen[name] {
+			return nil, resource.NewConfigValidationError(path, errors.Errorf("camera %q is configured more than once", name))
+		}
+		seen[name] = true
+	}
+	if cfg.Threshold < 0 || cfg.Threshold > 1 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("threshold must be between 0 and 1, got %v", cfg.Threshold))
+	}
+	if cfg.Scale < 0 || cfg.Scale > 1 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("scale must be between 0 and 1, got %v", cfg.Scale))
+	}
+	if cfg.TemplatesDirectory != "" {
+		info, err := os.Stat(cfg.TemplatesDirectory)
+		if err != nil {
+			return nil, resource.NewConfigValidationError(path,
+				errors.Wrap(err, "cannot access path_to_templates_directory"))
+		}
+		if !info.IsDir() {
+			return nil, resource.NewConfigValidationError(path,
+				errors.Errorf("path_to_templates_directory %q is not a directory", cfg.TemplatesDirectory))
+		}
+	} else if cfg.MergeEmbeddedTemplates {
+		return nil, resource.NewConfigValidationError(path,
+			errors.New("merge_embedded_templates requires path_to_templates_directory"))
+	}
+	if cfg.UploadedTemplatesDirectory != "" {
+		// the directory is created by the first upload
+		if info, err := os.Stat(cfg.UploadedTemplatesDirectory); err == nil && !info.IsDir() {
+			return nil, resource.NewConfigValidationError(path,
+				errors.Errorf("uploaded_templates_directory %q is not a directory", cfg.UploadedTemplatesDirectory))
+		}
+	}
+	if _, err := parseCorrelationBackend(cfg.CorrelationBackend); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
+	if _, err := parseSearchMode(cfg.SearchMode); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
+	if cfg.PyramidLevels < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("pyramid_levels must not be negative, got %d", cfg.PyramidLevels))
+	}
+	if cfg.PyramidCandidateThreshold < 0 || cfg.PyramidCandidateThreshold > 1 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("pyramid_candidate_threshold must be between 0 and 1, got %v", cfg.PyramidCandidateThreshold))
+	}
+	if err := cfg.validateTemplateScales(); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
+	if cfg.Stride < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("stride must not be negative, got %d", cfg.Stride))
+	}
+	if cfg.NMSIoU < 0 || cfg.NMSIoU > 1 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("nms_iou_threshold must be between 0 and 1, got %v", cfg.NMSIoU))
+	}
+	if cfg.EdgeThreshold < 0 || cfg.EdgeThreshold > maxEdgeThreshold {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("edge_threshold must be between 0 and %d, got %d", maxEdgeThreshold, cfg.EdgeThreshold))
+	}
+	if cfg.NumWorkers < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("num_workers must not be negative, got %d", cfg.NumWorkers))
+	}
+	if cfg.PollRateHz < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("poll_rate_hz must not be negative, got %v", cfg.PollRateHz))
+	}
+	if cfg.MaxResultAgeMs < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("max_result_age_ms must not be negative, got %d", cfg.MaxResultAgeMs))
+	}
+	if cfg.TrackIDsInLabels && !cfg.Tracking {
+		return nil, resource.NewConfigValidationError(path, errors.New("track_ids_in_labels requires tracking"))
+	}
+	if cfg.TrackMaxDistance < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("track_max_distance must not be negative, got %v", cfg.TrackMaxDistance))
+	}
+	if cfg.TrackMaxMissedFrames < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.Errorf("track_max_missed_frames must not be negative, got %d", cfg.TrackMaxMissedFrames))
+	}
+	if cfg.KalmanFilter && !cfg.Tracking {
+		return nil, resource.NewConfigValidationError(path, errors.New("kalman_filter requires tracking"))
+	}
+	if cfg.KalmanProcessNoise < 0 || cfg.KalmanMeasurementNoise < 0 {
+		return nil, resource.NewConfigValidationError(path,
+			errors.New("kalman_process_noise and kalman_measurement_noise must not be negative"))
+	}
+	if err := cfg.validateDebouncing(); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
+	for name, calibration := range cfg.SonarCalibrations {
+		if !seen[name] {
+			return nil, resource.NewConfigValidationError(path,
+				errors.Errorf("sonar_calibrations entry for %q is not a configured camera", name))
+		}
+		if calibration == nil {
+			return nil, resource.NewConfigValidationError(path,
+				errors.Errorf("sonar_calibrations entry for %q must not be empty", name))
+		}
+		if err := calibration.validate(); err != nil {
+			return nil, resource.NewConfigValidationError(path,
+				errors.Wrapf(err, "sonar_calibrations entry for %q", name))
+		}
+	}
+	for name, label := range cfg.TemplateLabels {
+		if label == "" {
+			return nil, resource.NewConfigValidationError(path,
+				errors.Errorf("template_labels entry for %q must not be empty", name))
+		}
+	}
+	return cfg.cameraNames(), nil
+}
+
+// cameraNames returns every configured camera, the default one first.
+func (cfg *TriangleFinderConfig) cameraNames() []string {
+	if cfg.Camera == "" {
+		return cfg.Cameras
+	}
+	return append([]string{cfg.Camera}, cfg.Cameras...)
 }
 
 type myTriangleFinder struct {
-	resource.AlwaysRebuild
+	name   resource.Name
+	logger logging.Logger
+
+	// updateMu serializes reconfigurations and runtime parameter updates,
+	// mu protects the cameras and the settings used by in-flight detections
+	updateMu   sync.Mutex
+	mu         sync.RWMutex
+	cams       map[string]camera.Camera
+	defaultCam string
+	config     *TriangleFinderConfig
+	opts       matchOptions
+	templates  []TemplateFromImage
 
-	name      resource.Name
-	logger    logging.Logger
-	cam       camera.Camera
-	config    *TriangleFinderConfig
-	templates []TemplateFromImage
-	scale     float64
+	// templates added with the upload_template command, and names of the configured templates removed with
+	// the delete_template command since the templates were last rebuilt by Reconfigure, both guarded by updateMu
+	uploaded []templateImage
+	removed  map[string]bool
+
+	// poller searches the cameras in the background when poll_rate_hz is set, guarded by updateMu,
+	// cache holds the latest result of each camera and searching the search in progress on each camera
+	poller    *poller
+	cacheMu   sync.Mutex
+	cache     map[string]*frameResult
+	searching map[string]chan struct{}
+
+	// trackers follow the triangles of each camera when tracking is enabled, each frame of the camera being
+	// fed once to its tracker
+	trackMu  sync.Mutex
+	trackers map[string]*tracker
+
+	statsMu     sync.Mutex
+	scaleCounts map[float64]int // number of detections made by templates of each scale factor
+	frames      int             // number of camera frames and images searched for detections
 }
 
 func newTriangleFinder(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (vision.Service, error) {
+	tf := &myTriangleFinder{
+		name:   conf.ResourceName(),
+		logger: logger,
+
+		removed:     map[string]bool{},
+		cache:       map[string]*frameResult{},
+		searching:   map[string]chan struct{}{},
+		trackers:    map[string]*tracker{},
+		scaleCounts: map[float64]int{},
+	}
+	if err := tf.Reconfigure(ctx, deps, conf); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// Reconfigure swaps the cameras and settings of the service. Templates are only rebuilt when a setting
+// they depend on changes, detections in flight finish with the settings they started with.
+func (tf *myTriangleFinder) Reconfigure(ctx context.Context, deps resource.Dependencies, conf resource.Config) error {
 	newConf, err := resource.NativeConfig[*TriangleFinderConfig](conf)
 	if err != nil {
-		return nil, errors.Errorf("failed to parse config for %s got: %s", ModelName, err)
+		return errors.Errorf("failed to parse config for %s got: %s", ModelName, err)
 	}
 
-	tf := &myTriangleFinder{
-		name:   conf.ResourceName(),
-		logger: logger,
-		config: newConf,
-		scale:  getScaleOrDefault(newConf.Scale),
+	opts, err := newMatchOptions(newConf)
+	if err != nil {
+		return errors.Errorf("failed to parse config for %s got: %s", ModelName, err)
+	}
+
+	// get cameras
+	cams := map[string]camera.Camera{}
+	for _, name := range newConf.cameraNames() {
+		cams[name], err = camera.FromDependencies(deps, name)
+		if err != nil {
+			return errors.Errorf("failed to get camera from dependencies for %s got: %s", ModelName, err)
+		}
+	}
+
+	tf.updateMu.Lock()
+	defer tf.updateMu.Unlock()
+
+	tf.mu.RLock()
+	oldConf, templates := tf.config, tf.templates
+	tf.mu.RUnlock()
+
+	uploaded := tf.uploaded
+	uploadsChanged := oldConf == nil || oldConf.UploadedTemplatesDirectory != newConf.UploadedTemplatesDirectory
+	if uploadsChanged && newConf.UploadedTemplatesDirectory != "" {
+		uploaded, err = readUploadedTemplates(newConf.UploadedTemplatesDirectory)
+		if err != nil {
+			return errors.Errorf("failed to load uploaded templates for %s got: %s", ModelName, err)
+		}
+	}
+
+	// deletions of configured templates only apply to the templates they were made on
+	removed := tf.removed
+	if oldConf != nil && templatesChanged(oldConf, newConf) {
+		removed = map[string]bool{}
 	}
-	// get camera
-	tf.cam, err = camera.FromDependencies(deps, newConf.Camera)
+
+	if oldConf == nil || uploadsChanged || templatesChanged(oldConf, newConf) {
+		templates, err = buildTemplates(newConf, uploaded, removed, tf.logger)
+		if err != nil {
+			return errors.Errorf("failed to load template images for %s got: %s", ModelName, err)
+		}
+		if len(templates) == 0 {
+			return errors.Errorf("no valid templates found?!")
+		}
+	}
+
+	tf.mu.Lock()
+	tf.cams = cams
+	tf.defaultCam = newConf.cameraNames()[0]
+	tf.config = newConf
+	tf.opts = opts
+	tf.templates = templates
+	tf.uploaded = uploaded
+	tf.mu.Unlock()
+	tf.removed = removed
+
+	tf.resetResults(newConf)
+	return nil
+}
+
+// templatesChanged returns true if the templates built for oldConf cannot be used with newConf.
+func templatesChanged(oldConf, newConf *TriangleFinderConfig) bool {
+	return getScaleOrDefault(oldConf.Scale) != getScaleOrDefault(newConf.Scale) ||
+		getEdgeThresholdOrDefault(oldConf.EdgeThreshold) != getEdgeThresholdOrDefault(newConf.EdgeThreshold) ||
+		oldConf.TemplatesDirectory != newConf.TemplatesDirectory ||
+		oldConf.MergeEmbeddedTemplates != newConf.MergeEmbeddedTemplates ||
+		!reflect.DeepEqual(oldConf.TemplateLabels, newConf.TemplateLabels) ||
+		!reflect.DeepEqual(oldConf.templateScaleFactors(), newConf.templateScaleFactors())
+}
+
+// newMatchOptions returns the options used to match templates with the settings of the config.
+func newMatchOptions(cfg *TriangleFinderConfig) (matchOptions, error) {
+	backend, err := parseCorrelationBackend(cfg.CorrelationBackend)
+	if err != nil {
+		return matchOptions{}, err
+	}
+	mode, err := parseSearchMode(cfg.SearchMode)
 	if err != nil {
-		return nil, errors.Errorf("failed to get camera from dependencies for %s got: %s", ModelName, err)
+		return matchOptions{}, err
 	}
+	return matchOptions{
+		stride:        getStrideOrDefault(cfg.Stride),
+		threshold:     cfg.Threshold,
+		scale:         getScaleOrDefault(cfg.Scale),
+		edgeThreshold: getEdgeThresholdOrDefault(cfg.EdgeThreshold),
+		backend:       backend,
+		workers:       cfg.NumWorkers,
+		nmsIoU:        cfg.NMSIoU,
+
+		mode:               mode,
+		pyramidLevels:      cfg.PyramidLevels,
+		candidateThreshold: cfg.PyramidCandidateThreshold,
+	}, nil
+}
 
-	tf.templates, err = loadTemplates(tf.scale)
+// templateBuildOptions returns the options templates are built with for the config.
+func (cfg *TriangleFinderConfig) templateBuildOptions() templateOptions {
+	return templateOptions{
+		scale:         getScaleOrDefault(cfg.Scale),
+		scaleFactors:  cfg.templateScaleFactors(),
+		edgeThreshold: getEdgeThresholdOrDefault(cfg.EdgeThreshold),
+	}
+}
+
+// buildTemplates builds the configured templates, except the removed ones, followed by the uploaded templates.
+func buildTemplates(
+	cfg *TriangleFinderConfig,
+	uploaded []templateImage,
+	removed map[string]bool,
+	logger logging.Logger,
+) ([]TemplateFromImage, error) {
+	configured, err := loadConfiguredTemplates(cfg, logger)
 	if err != nil {
-		return nil, errors.Errorf("failed to load template images for %s got: %s", ModelName, err)
+		return nil, err
 	}
+	templates := make([]TemplateFromImage, 0, len(configured))
+	for _, template := range configured {
+		if !removed[template.name] {
+			templates = append(templates, template)
+		}
+	}
+	for _, upload := range uploaded {
+		uploadTemplates, err := newTemplatesFromImage(upload, cfg.templateBuildOptions())
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, uploadTemplates...)
+	}
+	return templates, nil
+}
 
-	if len(tf.templates) == 0 {
-		return nil, errors.Errorf("no valid templates found?!")
+// loadConfiguredTemplates loads the templates from the configured sources, falling back to the
+// embedded templates if the configured directory does not contain any, and applies the configured labels.
+func loadConfiguredTemplates(cfg *TriangleFinderConfig, logger logging.Logger) ([]TemplateFromImage, error) {
+	opts := cfg.templateBuildOptions()
+	templates, err := loadTemplatesFrom(cfg.templateSources(), opts)
+	if err != nil {
+		return nil, err
 	}
-	return tf, nil
+	if len(templates) == 0 && cfg.TemplatesDirectory != "" && !cfg.MergeEmbeddedTemplates {
+		logger.Warnf("no templates found in %q, falling back to the embedded templates", cfg.TemplatesDirectory)
+		templates, err = loadTemplatesFrom([]templateSource{embeddedTemplateSource()}, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range templates {
+		if label, ok := cfg.TemplateLabels[templates[i].name]; ok {
+			templates[i].label = label
+		}
+	}
+	return templates, nil
 }
 
 func getScaleOrDefault(scale float64) float64 {
@@ -94,20 +571,107 @@ func getScaleOrDefault(scale float64) float64 {
 	}
 	return scale
 }
+
+func getStrideOrDefault(stride int) int {
+	if stride <= 0 {
+		return 2
+	}
+	return stride
+}
+
+func getEdgeThresholdOrDefault(edgeThreshold int) int {
+	if edgeThreshold <= 0 {
+		return defaultEdgeThreshold
+	}
+	return edgeThreshold
+}
 func (tf *myTriangleFinder) Name() resource.Name {
 	return tf.name
 }
 
 func (tf *myTriangleFinder) GetProperties(ctx context.Context, extra map[string]interface{}) (*vision.Properties, error) {
+	tf.mu.RLock()
+	cfg := tf.config
+	tf.mu.RUnlock()
 	return &vision.Properties{
 		DetectionSupported:      true,
-		ClassificationSupported: false,
-		ObjectPCDsSupported:     false,
+		ClassificationSupported: true,
+		ObjectPCDsSupported:     len(cfg.SonarCalibrations) > 0,
 	}, nil
 }
 
-func (tf *myTriangleFinder) findTriangles(imgMatrix [][]float64) []objdet.Detection {
-	return findTriangles(tf.templates, imgMatrix, 2, tf.config.Threshold, tf.scale)
+// imageSearch is the result of searching an image for triangles.
+type imageSearch struct {
+	matches         []Match
+	bestCorrelation float32     // best correlation of any window searched, even below the threshold, 0 if none
+	edges           [][]float64 // edge matrix of the image the triangles were searched in
+}
+
+// detect finds the triangles in the image with the current settings.
+func (tf *myTriangleFinder) detect(ctx context.Context, img image.Image) ([]Match, error) {
+	search, err := tf.search(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	return search.matches, nil
+}
+
+// search finds the triangles in the image with the current settings, and also returns the best correlation
+// found and the edge matrix of the image.
+func (tf *myTriangleFinder) search(ctx context.Context, img image.Image) (*imageSearch, error) {
+	tf.mu.RLock()
+	templates, opts := tf.templates, tf.opts
+	tf.mu.RUnlock()
+
+	imgMatrix := ImageToMatrixWithEdgeThreshold(img, opts.scale, opts.edgeThreshold)
+	opts.best = &bestCorrelation{}
+	matches, err := detectMatches(ctx, templates, imgMatrix, opts)
+	if err != nil {
+		return nil, err
+	}
+	best, _ := opts.best.get()
+	return &imageSearch{matches: matches, bestCorrelation: best, edges: imgMatrix}, nil
+}
+
+// recordScales counts the detections made at each template scale in a frame, reported by the get_scale_stats
+// command. It is called once per frame searched for detections, not by the commands and classifications
+// searching or reading a frame too.
+func (tf *myTriangleFinder) recordScales(matches []Match) {
+	tf.statsMu.Lock()
+	defer tf.statsMu.Unlock()
+	tf.frames++
+	for _, match := range matches {
+		tf.scaleCounts[match.ScaleFactor]++
+	}
+}
+
+// getCamera returns the configured camera with the given name, the default camera if the name is empty.
+func (tf *myTriangleFinder) getCamera(cameraName string) (camera.Camera, error) {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	if cameraName == "" {
+		cameraName = tf.defaultCam
+	}
+	cam, ok := tf.cams[cameraName]
+	if !ok {
+		names := make([]string, 0, len(tf.cams))
+		for name := range tf.cams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("unknown camera %q for %s, expected one of %v", cameraName, ModelName, names)
+	}
+	return cam, nil
+}
+
+// imageFromCamera gets and decodes an image from the named camera.
+func (tf *myTriangleFinder) imageFromCamera(ctx context.Context, cameraName string) (image.Image, error) {
+	cam, err := tf.getCamera(cameraName)
+	if err != nil {
+		return nil, err
+	}
+	mimeType := "image/jpeg"
+	return camera.DecodeImageFromCamera(ctx, mimeType, nil, cam)
 }
 
 func (tf *myTriangleFinder) DetectionsFromCamera(
@@ -115,26 +679,37 @@ func (tf *myTriangleFinder) DetectionsFromCamera(
 	cameraName string,
 	extra map[string]interface{},
 ) ([]objdet.Detection, error) {
-	mimeType := "image/jpeg"
-	image, err := camera.DecodeImageFromCamera(ctx, mimeType, nil, tf.cam)
+	result, err := tf.latestResult(ctx, cameraName)
 	if err != nil {
-		return nil, errors.Errorf("failed to get and decode image for %s got: %s", ModelName, err)
+		return nil, errors.Errorf("failed to get detections from camera for %s got: %s", ModelName, err)
 	}
+	return result.detections(tf.trackIDsInLabels()), nil
+}
 
-	imgMatrix := ImageToMatrix(image, tf.scale)
-	return tf.findTriangles(imgMatrix), nil
+// trackIDsInLabels returns true if the track ids are appended to the labels of the detections.
+func (tf *myTriangleFinder) trackIDsInLabels() bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.config.Tracking && tf.config.TrackIDsInLabels
 }
 
 func (tf *myTriangleFinder) Detections(ctx context.Context, img image.Image, extra map[string]interface{}) ([]objdet.Detection, error) {
-	// Convert image to grayscale
-	mat := ImageToMatrix(img, tf.scale)
-	return tf.findTriangles(mat), nil
+	matches, err := tf.detect(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	tf.recordScales(matches)
+	return matchesToDetections(matches), nil
 }
 
 func (tf *myTriangleFinder) Classifications(ctx context.Context, img image.Image,
 	n int, extra map[string]interface{},
 ) (classification.Classifications, error) {
-	return nil, errUnimplemented
+	search, err := tf.search(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	return classifyMatches(search.matches, search.bestCorrelation, n), nil
 }
 
 func (tf *myTriangleFinder) ClassificationsFromCamera(
@@ -143,7 +718,11 @@ func (tf *myTriangleFinder) ClassificationsFromCamera(
 	n int,
 	extra map[string]interface{},
 ) (classification.Classifications, error) {
-	return nil, errUnimplemented
+	result, err := tf.latestResult(ctx, cameraName)
+	if err != nil {
+		return nil, errors.Errorf("failed to get classifications from camera for %s got: %s", ModelName, err)
+	}
+	return classifyMatches(result.matches, result.bestCorrelation, n), nil
 }
 
 func (tf *myTriangleFinder) GetObjectPointClouds(
@@ -151,7 +730,11 @@ func (tf *myTriangleFinder) GetObjectPointClouds(
 	cameraName string,
 	extra map[string]interface{},
 ) ([]*vis.Object, error) {
-	return nil, errUnimplemented
+	objects, err := tf.objects(ctx, cameraName)
+	if err != nil {
+		return nil, errors.Errorf("failed to get object point clouds from camera for %s got: %s", ModelName, err)
+	}
+	return objects, nil
 }
 
 func (tf *myTriangleFinder) CaptureAllFromCamera(
@@ -160,29 +743,38 @@ func (tf *myTriangleFinder) CaptureAllFromCamera(
 	opt viscapture.CaptureOptions,
 	extra map[string]interface{},
 ) (viscapture.VisCapture, error) {
-	res := viscapture.VisCapture{}
-	mimeType := "image/jpeg"
-	image, err := camera.DecodeImageFromCamera(ctx, mimeType, nil, tf.cam)
-	if err != nil {
-		return viscapture.VisCapture{}, errors.Errorf("failed to get image from camera for %s got: %s", ModelName, err)
+	var result *frameResult
+	if opt.ReturnDetections || opt.ReturnClassifications {
+		var err error
+		result, err = tf.latestResult(ctx, cameraName)
+		if err != nil {
+			return viscapture.VisCapture{}, errors.Errorf("failed to get detections from camera for %s got: %s", ModelName, err)
+		}
+	} else {
+		image, err := tf.imageFromCamera(ctx, cameraName)
+		if err != nil {
+			return viscapture.VisCapture{}, errors.Errorf("failed to get image from camera for %s got: %s", ModelName, err)
+		}
+		result = &frameResult{img: image, capturedAt: time.Now()}
+	}
+	res := viscapture.VisCapture{
+		Extra: map[string]interface{}{"captured_at": result.capturedAt.Format(time.RFC3339Nano)},
 	}
 	if opt.ReturnImage {
-		res.Image = image
+		res.Image = result.img
 	}
 	if opt.ReturnDetections {
-		dets, err := tf.Detections(ctx, image, extra)
-		if err != nil {
-			return viscapture.VisCapture{}, errors.Errorf("failed to get detections from camera for %s got: %s", ModelName, err)
-		}
-		res.Detections = dets
+		res.Detections = result.detections(tf.trackIDsInLabels())
+	}
+	if opt.ReturnClassifications {
+		res.Classifications = classifyMatches(result.matches, result.bestCorrelation, 0)
 	}
 	return res, nil
 }
 
-func (tf *myTriangleFinder) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
-	return nil, errUnimplemented
-}
-
 func (tf *myTriangleFinder) Close(ctx context.Context) error {
+	tf.updateMu.Lock()
+	defer tf.updateMu.Unlock()
+	tf.stopPolling()
 	return nil
 }
@@ -1,16 +1,36 @@
 package triangle_on_sonar_finder
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/png"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
+	"go.viam.com/rdk/components/camera"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/vision"
+	"go.viam.com/rdk/testutils/inject"
+	"go.viam.com/rdk/utils"
+	"go.viam.com/rdk/vision/classification"
+	objdet "go.viam.com/rdk/vision/objectdetection"
+	"go.viam.com/rdk/vision/viscapture"
 	"go.viam.com/test"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 func openImage(fn string) (image.Image, error) {
@@ -85,6 +105,36 @@ func BenchmarkTriangls(t *testing.B) {
 
 }
 
+// compares the naive per-window mean/variance with the summed-area tables
+func BenchmarkFindMatch(b *testing.B) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(b, err, test.ShouldBeNil)
+
+	img, err := openImage("inputs/image_1.png")
+	test.That(b, err, test.ShouldBeNil)
+	imgMatrix := ImageToMatrix(img, scale)
+
+	b.Run("naive", func(b *testing.B) {
+		for b.Loop() {
+			for i := range templates {
+				naiveFindMatch(&templates[i], imgMatrix, 2, .75, scale)
+			}
+		}
+	})
+	for _, backend := range []correlationBackend{backendSpatial, backendFFT} {
+		opts := matchOptions{stride: 2, threshold: .75, scale: scale, backend: backend}
+		b.Run("integral-"+string(backend), func(b *testing.B) {
+			for b.Loop() {
+				frame := newEdgeFrame(imgMatrix)
+				for i := range templates {
+					templates[i].findMatchInFrame(frame, opts)
+				}
+			}
+		})
+	}
+}
+
 // TestTemplateResizing tests that templates are resized proportionally
 func TestTemplateResizing(t *testing.T) {
 	// Use an actual template image
@@ -197,3 +247,1500 @@ func TestCorrelationHistogramGonum(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLoadTemplatesFromDirectory(t *testing.T) {
+	scale := 0.5
+	dir := t.TempDir()
+	data, err := os.ReadFile("templates/triangle_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, os.WriteFile(filepath.Join(dir, "triangle_1.png"), data, 0o600), test.ShouldBeNil)
+	test.That(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a template"), 0o600), test.ShouldBeNil)
+
+	templates, err := loadTemplatesFrom([]templateSource{directoryTemplateSource(dir)}, templateOptions{scale: scale})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(templates), test.ShouldEqual, 3)
+
+	// merging the directory with the embedded templates, whose ids are prefixed to tell the two triangle_1.png apart
+	cfg := &TriangleFinderConfig{TemplatesDirectory: dir, MergeEmbeddedTemplates: true, Scale: scale}
+	templates, err = loadTemplatesFrom(cfg.templateSources(), templateOptions{scale: scale})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(templates), test.ShouldEqual, 18)
+	test.That(t, templates[0].name, test.ShouldEqual, "triangle_1.png")
+	test.That(t, templates[3].name, test.ShouldEqual, "embedded/triangle_1.png")
+	test.That(t, templates[3].label, test.ShouldEqual, "triangle")
+	_, err = loadTemplatesFrom([]templateSource{directoryTemplateSource(dir), embeddedTemplateSource()}, templateOptions{scale: scale})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "triangle_1.png")
+
+	// labels and deletions apply to a single template
+	cfg.Camera = "cam"
+	cfg.TemplateLabels = map[string]string{"embedded/triangle_1.png": "marker"}
+	tf := newTestFinder(t, cfg, newTestCamera(t, "cam", "inputs/image_1.png"))
+	res, err := tf.DoCommand(context.Background(), map[string]interface{}{"command": "delete_template", "id": "triangle_1.png"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["templates"], test.ShouldEqual, 15)
+	res, err = tf.DoCommand(context.Background(), map[string]interface{}{"command": "list_templates"})
+	test.That(t, err, test.ShouldBeNil)
+	first := res["templates"].([]interface{})[0].(map[string]interface{})
+	test.That(t, first["id"], test.ShouldEqual, "embedded/triangle_1.png")
+	test.That(t, first["label"], test.ShouldEqual, "marker")
+
+	// an empty directory falls back to the embedded templates
+	cfg = &TriangleFinderConfig{TemplatesDirectory: t.TempDir(), Scale: scale}
+	templates, err = loadConfiguredTemplates(cfg, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(templates), test.ShouldEqual, 15)
+
+	// undecodable and unreadable templates are reported
+	test.That(t, os.WriteFile(filepath.Join(dir, "broken.png"), []byte("not a png"), 0o600), test.ShouldBeNil)
+	_, err = loadTemplatesFrom([]templateSource{directoryTemplateSource(dir)}, templateOptions{scale: scale})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "broken.png")
+
+	_, err = loadTemplatesFrom([]templateSource{directoryTemplateSource(filepath.Join(dir, "missing"))}, templateOptions{scale: scale})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "cannot read template directory")
+}
+
+func TestTemplateLabels(t *testing.T) {
+	test.That(t, labelFromTemplateName("triangle_1.png"), test.ShouldEqual, "triangle")
+	test.That(t, labelFromTemplateName("target-lock-12.jpg"), test.ShouldEqual, "target-lock")
+	test.That(t, labelFromTemplateName("diamond.png"), test.ShouldEqual, "diamond")
+	test.That(t, labelFromTemplateName("brackets/wide_1.png"), test.ShouldEqual, "brackets")
+
+	scale := 0.5
+	dir := t.TempDir()
+	data, err := os.ReadFile("templates/triangle_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, os.Mkdir(filepath.Join(dir, "diamond"), 0o700), test.ShouldBeNil)
+	test.That(t, os.WriteFile(filepath.Join(dir, "diamond", "a.png"), data, 0o600), test.ShouldBeNil)
+	test.That(t, os.WriteFile(filepath.Join(dir, "triangle_1.png"), data, 0o600), test.ShouldBeNil)
+
+	cfg := &TriangleFinderConfig{TemplatesDirectory: dir, Scale: scale, TemplateLabels: map[string]string{"triangle_1.png": "marker"}}
+	templates, err := loadConfiguredTemplates(cfg, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(templates), test.ShouldEqual, 6)
+	labels := map[string]int{}
+	for _, tmpl := range templates {
+		labels[tmpl.label]++
+	}
+	test.That(t, labels, test.ShouldResemble, map[string]int{"diamond": 3, "marker": 3})
+
+	// identical templates with different labels are suppressed separately
+	img, err := openImage("inputs/image_3.png")
+	test.That(t, err, test.ShouldBeNil)
+	detections := findTriangles(templates, ImageToMatrix(img, scale), 2, 0.75, scale)
+	counts := map[string]int{}
+	for _, det := range detections {
+		counts[det.Label()]++
+	}
+	test.That(t, counts["diamond"], test.ShouldBeGreaterThan, 0)
+	test.That(t, counts["diamond"], test.ShouldEqual, counts["marker"])
+}
+
+func TestValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "triangle.png")
+	test.That(t, os.WriteFile(file, []byte{}, 0o600), test.ShouldBeNil)
+
+	deps, err := TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5, TemplatesDirectory: t.TempDir()}.Validate("path")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, deps, test.ShouldResemble, []string{"cam"})
+
+	for _, tc := range []struct {
+		cfg TriangleFinderConfig
+		err string
+	}{
+		{TriangleFinderConfig{}, `"camera_name"`},
+		{TriangleFinderConfig{Camera: "cam", Threshold: -0.1}, "threshold must be between 0 and 1"},
+		{TriangleFinderConfig{Camera: "cam", Threshold: 1.5}, "threshold must be between 0 and 1"},
+		{TriangleFinderConfig{Camera: "cam", Scale: -1}, "scale must be between 0 and 1"},
+		{TriangleFinderConfig{Camera: "cam", Scale: 2}, "scale must be between 0 and 1"},
+		{TriangleFinderConfig{Camera: "cam", TemplatesDirectory: filepath.Join(t.TempDir(), "missing")}, "cannot access"},
+		{TriangleFinderConfig{Camera: "cam", TemplatesDirectory: file}, "is not a directory"},
+		{TriangleFinderConfig{Camera: "cam", MergeEmbeddedTemplates: true}, "requires path_to_templates_directory"},
+		{TriangleFinderConfig{Camera: "cam", TemplateLabels: map[string]string{"a.png": ""}}, "must not be empty"},
+		{TriangleFinderConfig{Camera: "cam", CorrelationBackend: "gpu"}, "unknown correlation_backend"},
+		{TriangleFinderConfig{Camera: "cam", NumWorkers: -1}, "num_workers must not be negative"},
+		{TriangleFinderConfig{Camera: "cam", SearchMode: "random"}, "unknown search_mode"},
+		{TriangleFinderConfig{Cameras: []string{"cam", ""}}, "must not contain empty names"},
+		{TriangleFinderConfig{Camera: "cam", Cameras: []string{"cam"}}, "configured more than once"},
+		{TriangleFinderConfig{Camera: "cam", Stride: -2}, "stride must not be negative"},
+		{TriangleFinderConfig{Camera: "cam", NMSIoU: 1.5}, "nms_iou_threshold must be between 0 and 1"},
+		{TriangleFinderConfig{Camera: "cam", EdgeThreshold: 5000}, "edge_threshold must be between 0 and 1442"},
+		{TriangleFinderConfig{Camera: "cam", TemplateScales: []float64{1, 0}}, "template_scales must be positive"},
+		{TriangleFinderConfig{Camera: "cam", TemplateScales: []float64{1}, TemplateScaleMax: 2}, "cannot be used with"},
+		{TriangleFinderConfig{Camera: "cam", TemplateScaleMax: 2}, "must both be set and positive"},
+		{TriangleFinderConfig{Camera: "cam", TemplateScaleMin: 2, TemplateScaleMax: 1}, "must not be greater than"},
+		{TriangleFinderConfig{Camera: "cam", PyramidLevels: -1}, "pyramid_levels must not be negative"},
+		{TriangleFinderConfig{Camera: "cam", PyramidCandidateThreshold: 2}, "pyramid_candidate_threshold must be between 0 and 1"},
+	} {
+		_, err := tc.cfg.Validate("path")
+		test.That(t, err, test.ShouldNotBeNil)
+		test.That(t, err.Error(), test.ShouldContainSubstring, tc.err)
+		test.That(t, err.Error(), test.ShouldContainSubstring, `"path"`)
+	}
+}
+
+// naiveFindMatch is the reference implementation of FindMatch, recomputing the crop mean and variance per window
+func naiveFindMatch(t *TemplateFromImage, image [][]float64, stride int, threshold float32, scale float64) []Match {
+	height := len(image)
+	width := len(image[0])
+	var matches []Match
+	for i := 0; i < height-t.kernelHeight; i += stride {
+		for j := 0; j < width-t.kernelWidth; j += stride {
+			var cropSum float64 = 0
+			for y := 0; y < t.kernelHeight; y++ {
+				for x := 0; x < t.kernelWidth; x++ {
+					cropSum += image[i+y][j+x]
+				}
+			}
+			cropMean := cropSum / float64(t.kernelHeight*t.kernelWidth)
+
+			sumProduct := 0.0
+			sumCropSquared := 0.0
+			for y := 0; y < t.kernelHeight; y++ {
+				for x := 0; x < t.kernelWidth; x++ {
+					normalizedCrop := image[i+y][j+x] - cropMean
+					sumProduct += normalizedCrop * t.kernel[y][x]
+					sumCropSquared += normalizedCrop * normalizedCrop
+				}
+			}
+
+			denominator := float32(math.Sqrt(float64(float32(sumCropSquared) * t.sumKernel)))
+			if denominator > 0 {
+				corr := float32(sumProduct) / denominator
+				if corr > threshold {
+					matches = append(matches, Match{
+						X:      int(float64(j+t.padding) * 1 / scale),
+						Y:      int(float64(i+t.padding) * 1 / scale),
+						Width:  t.originalWidth,
+						Height: t.originalHeight,
+						Score:  corr,
+						Label:  t.label,
+					})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func TestIntegralImageMatchesNaive(t *testing.T) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(t, err, test.ShouldBeNil)
+
+	img, err := openImage("inputs/image_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	// the naive matcher is slow, so only a crop around a triangle is checked, BenchmarkFindMatch covers whole frames
+	imgMatrix := ImageToMatrix(img, scale)[380:540]
+	for i, row := range imgMatrix {
+		imgMatrix[i] = row[440:640]
+	}
+
+	found := 0
+	for _, tmpl := range templates {
+		expected := naiveFindMatch(&tmpl, imgMatrix, 2, 0.6, scale)
+		actual := tmpl.FindMatch(imgMatrix, 2, 0.6, scale)
+		test.That(t, len(actual), test.ShouldEqual, len(expected))
+		for i := range expected {
+			test.That(t, actual[i].GetBoundingBox(), test.ShouldResemble, expected[i].GetBoundingBox())
+			test.That(t, actual[i].Score, test.ShouldAlmostEqual, expected[i].Score, 1e-4)
+		}
+		found += len(expected)
+	}
+	test.That(t, found, test.ShouldBeGreaterThan, 0)
+}
+
+func TestFFTBackendMatchesSpatial(t *testing.T) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(t, err, test.ShouldBeNil)
+
+	img, err := openImage("inputs/image_3.png")
+	test.That(t, err, test.ShouldBeNil)
+	frame := newEdgeFrame(ImageToMatrix(img, scale))
+
+	for _, tmpl := range templates {
+		expected := tmpl.findMatchInFrame(frame, matchOptions{stride: 2, threshold: 0.6, scale: scale, backend: backendSpatial})
+		actual := tmpl.findMatchInFrame(frame, matchOptions{stride: 2, threshold: 0.6, scale: scale, backend: backendFFT})
+		test.That(t, len(actual), test.ShouldEqual, len(expected))
+		for i := range expected {
+			test.That(t, actual[i].GetBoundingBox(), test.ShouldResemble, expected[i].GetBoundingBox())
+			test.That(t, actual[i].Score, test.ShouldAlmostEqual, expected[i].Score, 1e-4)
+		}
+	}
+
+	// auto picks the backend by kernel size
+	test.That(t, backendAuto.useFFT(&TemplateFromImage{kernelWidth: 24, kernelHeight: 22}), test.ShouldBeFalse)
+	test.That(t, backendAuto.useFFT(&TemplateFromImage{kernelWidth: 67, kernelHeight: 55}), test.ShouldBeTrue)
+}
+
+func TestTemplateLargerThanImage(t *testing.T) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the frame is smaller than every template, no window fits
+	img := image.NewGray(image.Rect(0, 0, 30, 30))
+	draw.Draw(img, image.Rect(8, 8, 22, 22), image.White, image.Point{}, draw.Src)
+	imgMatrix := ImageToMatrix(img, scale)
+	for _, backend := range []correlationBackend{backendSpatial, backendFFT} {
+		for _, mode := range []searchMode{searchExhaustive, searchPyramid} {
+			opts := matchOptions{stride: 2, threshold: 0.1, scale: scale, backend: backend, mode: mode}
+			detections, err := detectTriangles(context.Background(), templates, imgMatrix, opts)
+			test.That(t, err, test.ShouldBeNil)
+			test.That(t, detections, test.ShouldBeEmpty)
+		}
+	}
+}
+
+func TestParallelMatchingIsDeterministic(t *testing.T) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(t, err, test.ShouldBeNil)
+
+	img, err := openImage("inputs/image_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	imgMatrix := ImageToMatrix(img, scale)
+
+	opts := matchOptions{stride: 2, threshold: 0.6, scale: scale, workers: 1}
+	expected, err := matchTemplates(context.Background(), templates, newEdgeFrame(imgMatrix), opts)
+	test.That(t, err, test.ShouldBeNil)
+	expectedDetections, err := detectTriangles(context.Background(), templates, imgMatrix, opts)
+	test.That(t, err, test.ShouldBeNil)
+
+	// more workers than templates splits the templates into bands of rows
+	for _, workers := range []int{3, 16, 64} {
+		opts.workers = workers
+		actual, err := matchTemplates(context.Background(), templates, newEdgeFrame(imgMatrix), opts)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, actual, test.ShouldResemble, expected)
+
+		detections, err := detectTriangles(context.Background(), templates, imgMatrix, opts)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, detections, test.ShouldResemble, expectedDetections)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = detectTriangles(ctx, templates, imgMatrix, opts)
+	test.That(t, err, test.ShouldBeError, context.Canceled)
+}
+
+// the pyramid search must find the same triangles as the exhaustive search
+func TestPyramidSearchRecall(t *testing.T) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(t, err, test.ShouldBeNil)
+
+	for _, fn := range []string{"inputs/image_1.png", "inputs/image_2.png", "inputs/image_3.png"} {
+		img, err := openImage(fn)
+		test.That(t, err, test.ShouldBeNil)
+		imgMatrix := ImageToMatrix(img, scale)
+
+		opts := matchOptions{stride: 2, threshold: 0.75, scale: scale}
+		exhaustive, err := detectTriangles(context.Background(), templates, imgMatrix, opts)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, exhaustive, test.ShouldNotBeEmpty)
+
+		opts.mode = searchPyramid
+		pyramid, err := detectTriangles(context.Background(), templates, imgMatrix, opts)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, len(pyramid), test.ShouldEqual, len(exhaustive))
+		for _, expected := range exhaustive {
+			found := false
+			for _, det := range pyramid {
+				if calculateIoU(expected.BoundingBox(), det.BoundingBox()) > 0.5 {
+					found = true
+					break
+				}
+			}
+			test.That(t, found, test.ShouldBeTrue)
+		}
+	}
+}
+
+func BenchmarkPyramidSearch(b *testing.B) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(b, err, test.ShouldBeNil)
+
+	img, err := openImage("inputs/image_1.png")
+	test.That(b, err, test.ShouldBeNil)
+	imgMatrix := ImageToMatrix(img, scale)
+
+	for _, mode := range []searchMode{searchExhaustive, searchPyramid} {
+		opts := matchOptions{stride: 2, threshold: .75, scale: scale, mode: mode}
+		b.Run(string(mode), func(b *testing.B) {
+			for b.Loop() {
+				detections, err := detectTriangles(context.Background(), templates, imgMatrix, opts)
+				test.That(b, err, test.ShouldBeNil)
+				test.That(b, len(detections), test.ShouldEqual, 5)
+			}
+		})
+	}
+}
+
+func TestTemplateScales(t *testing.T) {
+	test.That(t, (&TriangleFinderConfig{}).templateScaleFactors(), test.ShouldBeNil)
+	test.That(t, (&TriangleFinderConfig{TemplateScales: []float64{0.5, 2}}).templateScaleFactors(),
+		test.ShouldResemble, []float64{0.5, 2})
+	test.That(t, (&TriangleFinderConfig{TemplateScaleMin: 0.5, TemplateScaleMax: 1.5}).templateScaleFactors(),
+		test.ShouldResemble, []float64{0.5, 1, 1.5})
+	test.That(t, (&TriangleFinderConfig{TemplateScaleMin: 0.5, TemplateScaleMax: 2, TemplateScaleSteps: 4}).templateScaleFactors(),
+		test.ShouldResemble, []float64{0.5, 1, 1.5, 2})
+
+	scale := 0.5
+	cfg := &TriangleFinderConfig{TemplateScales: []float64{0.8, 1}, Scale: scale}
+	templates, err := loadConfiguredTemplates(cfg, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(templates), test.ShouldEqual, 10)
+
+	img, err := openImage("inputs/image_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	matches, err := detectMatches(context.Background(), templates, ImageToMatrix(img, scale),
+		matchOptions{stride: 2, threshold: 0.75, scale: scale})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, matches, test.ShouldNotBeEmpty)
+
+	tf := &myTriangleFinder{opts: matchOptions{scale: scale}, scaleCounts: map[float64]int{}}
+	tf.recordScales(matches)
+	stats, err := tf.DoCommand(context.Background(), map[string]interface{}{"command": "get_scale_stats"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, stats["frames"], test.ShouldEqual, 1)
+	total := 0
+	for _, entry := range stats["scales"].([]interface{}) {
+		scaleStats := entry.(map[string]interface{})
+		test.That(t, scaleStats["scale_factor"], test.ShouldBeIn, 0.8, 1.0)
+		test.That(t, scaleStats["template_scale"], test.ShouldAlmostEqual, scaleStats["scale_factor"].(float64)*scale)
+		total += scaleStats["detections"].(int)
+	}
+	test.That(t, total, test.ShouldEqual, len(matches))
+
+	_, err = tf.DoCommand(context.Background(), map[string]interface{}{"command": "dance"})
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// each frame searched for detections is counted once, whatever reads its result, and commands searching
+	// frames of their own are not counted
+	ctx := context.Background()
+	tf = newTestFinder(t, &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: scale, MaxResultAgeMs: 3600000},
+		newTestCamera(t, "cam", "inputs/image_1.png"))
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	_, err = tf.ClassificationsFromCamera(ctx, "", 0, nil)
+	test.That(t, err, test.ShouldBeNil)
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_latest_detections"})
+	test.That(t, err, test.ShouldBeNil)
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "debug_image"})
+	test.That(t, err, test.ShouldBeNil)
+	_, err = tf.Classifications(ctx, img, 0, nil)
+	test.That(t, err, test.ShouldBeNil)
+	stats, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_scale_stats"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, stats["frames"], test.ShouldEqual, 1)
+	total = 0
+	for _, entry := range stats["scales"].([]interface{}) {
+		total += entry.(map[string]interface{})["detections"].(int)
+	}
+	test.That(t, total, test.ShouldEqual, len(detections))
+	_, err = tf.Detections(ctx, img, nil)
+	test.That(t, err, test.ShouldBeNil)
+	stats, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_scale_stats"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, stats["frames"], test.ShouldEqual, 2)
+}
+
+func TestStrideNMSAndEdgeThreshold(t *testing.T) {
+	test.That(t, getStrideOrDefault(0), test.ShouldEqual, 2)
+	test.That(t, getStrideOrDefault(3), test.ShouldEqual, 3)
+	test.That(t, getEdgeThresholdOrDefault(0), test.ShouldEqual, defaultEdgeThreshold)
+
+	scale := 0.5
+	img, err := openImage("templates/triangle_1.png")
+	test.That(t, err, test.ShouldBeNil)
+
+	// a higher edge threshold keeps fewer edges in the template
+	edges := func(edgeThreshold int) int {
+		template, err := NewTemplateFromImageWithEdgeThreshold(img, scale, edgeThreshold)
+		test.That(t, err, test.ShouldBeNil)
+		count := 0
+		for _, row := range template.kernel {
+			for _, v := range row {
+				if v > 0 {
+					count++
+				}
+			}
+		}
+		return count
+	}
+	test.That(t, edges(400), test.ShouldBeLessThan, edges(defaultEdgeThreshold))
+
+	// a permissive NMS keeps more of the overlapping matches
+	templates, err := loadTemplates(scale)
+	test.That(t, err, test.ShouldBeNil)
+	input, err := openImage("inputs/image_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	imgMatrix := ImageToMatrix(input, scale)
+	opts := matchOptions{stride: 2, threshold: 0.75, scale: scale}
+	defaultNMS, err := detectMatches(context.Background(), templates, imgMatrix, opts)
+	test.That(t, err, test.ShouldBeNil)
+	opts.nmsIoU = 0.9
+	permissiveNMS, err := detectMatches(context.Background(), templates, imgMatrix, opts)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(permissiveNMS), test.ShouldBeGreaterThan, len(defaultNMS))
+}
+
+// newTestCamera returns a camera serving the given image file as a png
+func newTestCamera(t *testing.T, name, fn string) camera.Camera {
+	data, err := os.ReadFile(fn)
+	test.That(t, err, test.ShouldBeNil)
+	cam := inject.NewCamera(name)
+	cam.ImageFunc = func(ctx context.Context, mimeType string, extra map[string]interface{}) ([]byte, camera.ImageMetadata, error) {
+		return data, camera.ImageMetadata{MimeType: utils.MimeTypePNG}, nil
+	}
+	return cam
+}
+
+// newTestFinder builds the vision service from the config with the given cameras as dependencies
+func newTestFinder(t *testing.T, cfg *TriangleFinderConfig, cams ...camera.Camera) *myTriangleFinder {
+	return newTestFinderWithLogger(t, logging.NewTestLogger(t), cfg, cams...)
+}
+
+func newTestFinderWithLogger(t *testing.T, logger logging.Logger, cfg *TriangleFinderConfig, cams ...camera.Camera) *myTriangleFinder {
+	deps := resource.Dependencies{}
+	for _, cam := range cams {
+		deps[cam.Name()] = cam
+	}
+	conf := resource.Config{Name: "finder", API: vision.API, Model: Model, ConvertedAttributes: cfg}
+	svc, err := newTriangleFinder(context.Background(), deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+	t.Cleanup(func() { test.That(t, svc.Close(context.Background()), test.ShouldBeNil) })
+	return svc.(*myTriangleFinder)
+}
+
+// expireResults makes the cached results of the finder stale, so that the next request searches a new frame
+func expireResults(tf *myTriangleFinder) {
+	tf.cacheMu.Lock()
+	defer tf.cacheMu.Unlock()
+	for name, result := range tf.cache {
+		stale := *result
+		stale.capturedAt = stale.capturedAt.Add(-time.Hour)
+		tf.cache[name] = &stale
+	}
+}
+
+func TestMultipleCameras(t *testing.T) {
+	cfg := &TriangleFinderConfig{Camera: "port", Cameras: []string{"starboard"}, Threshold: 0.75, Scale: 0.5}
+	deps, err := cfg.Validate("path")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, deps, test.ShouldResemble, []string{"port", "starboard"})
+
+	tf := newTestFinder(t, cfg,
+		newTestCamera(t, "port", "inputs/image_1.png"),
+		newTestCamera(t, "starboard", "inputs/image_2.png"))
+
+	port, err := tf.DetectionsFromCamera(context.Background(), "port", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(port), test.ShouldEqual, 5)
+
+	starboard, err := tf.DetectionsFromCamera(context.Background(), "starboard", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(starboard), test.ShouldEqual, 2)
+
+	// no name uses the default camera
+	defaultCam, err := tf.DetectionsFromCamera(context.Background(), "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, defaultCam, test.ShouldResemble, port)
+
+	capture, err := tf.CaptureAllFromCamera(context.Background(), "starboard",
+		viscapture.CaptureOptions{ReturnImage: true, ReturnDetections: true}, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, capture.Image, test.ShouldNotBeNil)
+	test.That(t, len(capture.Detections), test.ShouldEqual, 2)
+
+	_, err = tf.DetectionsFromCamera(context.Background(), "bow", nil)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, `unknown camera "bow"`)
+}
+
+func TestRuntimeParams(t *testing.T) {
+	cfg := &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5, Tracking: true, MaxResultAgeMs: 3600000}
+	tf := newTestFinder(t, cfg, newTestCamera(t, "cam", "inputs/image_1.png"))
+	ctx := context.Background()
+
+	// a result cached with the initial threshold, with weaker detections and their tracks
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	weakest := 1.0
+	for _, det := range detections {
+		weakest = min(weakest, det.Score())
+	}
+	test.That(t, weakest, test.ShouldBeLessThan, 0.9)
+
+	res, err := tf.DoCommand(ctx, map[string]interface{}{"command": "get_config"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["threshold"], test.ShouldAlmostEqual, 0.75)
+	test.That(t, res["stride"], test.ShouldEqual, 2)
+	test.That(t, res["nms_iou_threshold"], test.ShouldEqual, defaultNMSIoU)
+	test.That(t, res["edge_threshold"], test.ShouldEqual, defaultEdgeThreshold)
+	test.That(t, res["templates"], test.ShouldEqual, 15)
+
+	// changing the threshold, stride or NMS keeps the templates
+	templates := tf.templates
+	res, err = tf.DoCommand(ctx, map[string]interface{}{
+		"command": "set_params", "threshold": 0.9, "stride": 1.0, "nms_iou_threshold": 0.5,
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["templates_rebuilt"], test.ShouldBeFalse)
+	test.That(t, res["threshold"], test.ShouldAlmostEqual, 0.9, 1e-6)
+	test.That(t, res["stride"], test.ShouldEqual, 1)
+	test.That(t, &tf.templates[0], test.ShouldEqual, &templates[0])
+
+	// the cached result and the tracks of the previous settings are dropped, the next request searches a new frame
+	tf.cacheMu.Lock()
+	test.That(t, tf.cache, test.ShouldBeEmpty)
+	tf.cacheMu.Unlock()
+	tracks, err := tf.DoCommand(ctx, map[string]interface{}{"command": "get_tracks"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, tracks["tracks"], test.ShouldBeEmpty)
+	detections, err = tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, detections, test.ShouldNotBeEmpty)
+	for _, det := range detections {
+		test.That(t, det.Score(), test.ShouldBeGreaterThan, 0.9)
+	}
+	latest, err := tf.DoCommand(ctx, map[string]interface{}{"command": "get_latest_detections"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, latest["count"], test.ShouldEqual, len(detections))
+
+	// setting the same scale again does not rebuild the templates either, a new one does
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "set_params", "scale": 0.5})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["templates_rebuilt"], test.ShouldBeFalse)
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "set_params", "scale": 0.4, "edge_threshold": 60.0})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["templates_rebuilt"], test.ShouldBeTrue)
+	test.That(t, res["scale"], test.ShouldEqual, 0.4)
+	test.That(t, tf.templates[0].kernelWidth, test.ShouldBeLessThan, templates[0].kernelWidth)
+
+	// invalid values are rejected and leave the settings untouched
+	for _, cmd := range []map[string]interface{}{
+		{"command": "set_params", "threshold": 2.0},
+		{"command": "set_params", "stride": 1.5},
+		{"command": "set_params", "stride": "fast"},
+		{"command": "set_params", "color": "red"},
+	} {
+		_, err = tf.DoCommand(ctx, cmd)
+		test.That(t, err, test.ShouldNotBeNil)
+	}
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_config"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["threshold"], test.ShouldAlmostEqual, 0.9, 1e-6)
+	test.That(t, res["stride"], test.ShouldEqual, 1)
+}
+
+func TestReconfigure(t *testing.T) {
+	ctx := context.Background()
+	port := newTestCamera(t, "port", "inputs/image_1.png")
+	starboard := newTestCamera(t, "starboard", "inputs/image_2.png")
+	deps := resource.Dependencies{port.Name(): port, starboard.Name(): starboard}
+	conf := func(cfg *TriangleFinderConfig) resource.Config {
+		return resource.Config{Name: "finder", API: vision.API, Model: Model, ConvertedAttributes: cfg}
+	}
+
+	tf := newTestFinder(t, &TriangleFinderConfig{Camera: "port", Threshold: 0.75, Scale: 0.5}, port)
+	templates := tf.templates
+
+	// a new camera and NMS setting keep the templates
+	err := tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{Camera: "starboard", Threshold: 0.75, Scale: 0.5, NMSIoU: 0.25}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, &tf.templates[0], test.ShouldEqual, &templates[0])
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(detections), test.ShouldEqual, 2)
+	_, err = tf.DetectionsFromCamera(ctx, "port", nil)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// a new scale or template set rebuilds them
+	err = tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{Camera: "starboard", Threshold: 0.8, Scale: 0.4}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, &tf.templates[0], test.ShouldNotEqual, &templates[0])
+	templates = tf.templates
+	err = tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{
+		Camera: "starboard", Threshold: 0.8, Scale: 0.4, TemplateScales: []float64{1},
+	}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(tf.templates), test.ShouldEqual, 5)
+
+	// deleted configured templates stay deleted until the templates are rebuilt, a template of a new
+	// directory with the same id is not hidden
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "delete_template", "id": "triangle_1.png"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(tf.templates), test.ShouldEqual, 4)
+	err = tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{
+		Camera: "starboard", Threshold: 0.75, Scale: 0.4, TemplateScales: []float64{1},
+	}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(tf.templates), test.ShouldEqual, 4)
+	dir := t.TempDir()
+	data, err := os.ReadFile("templates/triangle_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, os.WriteFile(filepath.Join(dir, "triangle_1.png"), data, 0o600), test.ShouldBeNil)
+	err = tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{
+		Camera: "starboard", Threshold: 0.8, Scale: 0.4, TemplateScales: []float64{1}, TemplatesDirectory: dir,
+	}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(tf.templates), test.ShouldEqual, 1)
+	test.That(t, tf.templates[0].name, test.ShouldEqual, "triangle_1.png")
+	err = tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{
+		Camera: "starboard", Threshold: 0.8, Scale: 0.4, TemplateScales: []float64{1},
+	}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(tf.templates), test.ShouldEqual, 5)
+
+	// a failed reconfiguration keeps the previous settings
+	err = tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{Camera: "bow", Scale: 0.4}))
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, tf.config.Camera, test.ShouldEqual, "starboard")
+
+	// detections in flight are not disturbed by reconfigurations
+	done := make(chan error)
+	go func() {
+		_, err := tf.DetectionsFromCamera(ctx, "starboard", nil)
+		done <- err
+	}()
+	err = tf.Reconfigure(ctx, deps, conf(&TriangleFinderConfig{Camera: "starboard", Threshold: 0.75, Scale: 0.5}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, <-done, test.ShouldBeNil)
+}
+
+func TestUploadTemplates(t *testing.T) {
+	ctx := context.Background()
+	cam := newTestCamera(t, "cam", "inputs/image_1.png")
+	dir := filepath.Join(t.TempDir(), "uploads")
+	cfg := &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5, UploadedTemplatesDirectory: dir}
+	tf := newTestFinder(t, cfg, cam)
+
+	data, err := os.ReadFile("templates/triangle_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	res, err := tf.DoCommand(ctx, map[string]interface{}{"command": "upload_template", "image": encoded, "label": "marker"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["id"], test.ShouldEqual, "uploaded/marker_1.png")
+	test.That(t, res["label"], test.ShouldEqual, "marker")
+	test.That(t, len(res["scales"].([]interface{})), test.ShouldEqual, len(defaultScaleFactors))
+	_, err = os.Stat(filepath.Join(dir, "marker_1.png"))
+	test.That(t, err, test.ShouldBeNil)
+
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "list_templates"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(res["templates"].([]interface{})), test.ShouldEqual, 6)
+
+	// the uploaded copy of triangle_1 finds the same triangles under its own label
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	labels := map[string]int{}
+	for _, det := range detections {
+		labels[det.Label()]++
+	}
+	test.That(t, labels["marker"], test.ShouldBeGreaterThan, 0)
+
+	// crops must be inside the image
+	_, err = tf.DoCommand(ctx, map[string]interface{}{
+		"command": "upload_template", "image": encoded,
+		"crop": map[string]interface{}{"x": 0.0, "y": 0.0, "width": 1000.0, "height": 10.0},
+	})
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "upload_template", "image": "not an image"})
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// uploads are loaded again from the directory when the service starts
+	restarted := newTestFinder(t, cfg, cam)
+	test.That(t, len(restarted.templates), test.ShouldEqual, len(tf.templates))
+
+	// configured templates are removed until the service restarts, uploaded ones for good
+	res, err = restarted.DoCommand(ctx, map[string]interface{}{"command": "delete_template", "id": "triangle_2.png"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["templates"], test.ShouldEqual, 15)
+	_, err = restarted.DoCommand(ctx, map[string]interface{}{"command": "set_params", "scale": 0.4})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(restarted.templates), test.ShouldEqual, 15)
+	_, err = restarted.DoCommand(ctx, map[string]interface{}{"command": "delete_template", "id": "uploaded/marker_1.png"})
+	test.That(t, err, test.ShouldBeNil)
+	_, err = os.Stat(filepath.Join(dir, "marker_1.png"))
+	test.That(t, os.IsNotExist(err), test.ShouldBeTrue)
+	_, err = restarted.DoCommand(ctx, map[string]interface{}{"command": "delete_template", "id": "uploaded/marker_1.png"})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestTemplateFromCamera(t *testing.T) {
+	ctx := context.Background()
+	cfg := &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5}
+	tf := newTestFinder(t, cfg, newTestCamera(t, "cam", "inputs/image_1.png"))
+	crop := map[string]interface{}{"x": 1060.0, "y": 900.0, "width": 42.0, "height": 38.0}
+
+	// a dry run only previews the template
+	res, err := tf.DoCommand(ctx, map[string]interface{}{
+		"command": "template_from_camera", "crop": crop, "label": "captured", "dry_run": true,
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["added"], test.ShouldBeFalse)
+	test.That(t, res["preview_mime_type"], test.ShouldEqual, "image/png")
+	data, err := base64.StdEncoding.DecodeString(res["preview"].(string))
+	test.That(t, err, test.ShouldBeNil)
+	preview, err := png.Decode(bytes.NewReader(data))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, preview.Bounds().Dx(), test.ShouldBeGreaterThan, 21)
+	test.That(t, len(tf.templates), test.ShouldEqual, 15)
+
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "template_from_camera", "crop": crop, "label": "captured"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["added"], test.ShouldBeTrue)
+	test.That(t, res["id"], test.ShouldEqual, "uploaded/captured_1.png")
+	test.That(t, len(tf.templates), test.ShouldEqual, 18)
+
+	// the new template finds the triangle it was cut from
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	found := false
+	for _, det := range detections {
+		if det.Label() == "captured" && det.BoundingBox().Overlaps(image.Rect(1060, 900, 1102, 938)) {
+			found = true
+		}
+	}
+	test.That(t, found, test.ShouldBeTrue)
+
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "template_from_camera", "crop": crop, "camera_name": "bow"})
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "template_from_camera"})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestDebugImage(t *testing.T) {
+	ctx := context.Background()
+	cfg := &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5}
+	tf := newTestFinder(t, cfg, newTestCamera(t, "cam", "inputs/image_1.png"))
+	input, err := openImage("inputs/image_1.png")
+	test.That(t, err, test.ShouldBeNil)
+
+	decode := func(encoded interface{}) image.Image {
+		data, err := base64.StdEncoding.DecodeString(encoded.(string))
+		test.That(t, err, test.ShouldBeNil)
+		img, err := png.Decode(bytes.NewReader(data))
+		test.That(t, err, test.ShouldBeNil)
+		return img
+	}
+
+	res, err := tf.DoCommand(ctx, map[string]interface{}{"command": "debug_image"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["detections"], test.ShouldEqual, 5)
+	test.That(t, res["edges"], test.ShouldBeNil)
+	annotated := decode(res["image"])
+	test.That(t, annotated.Bounds().Size(), test.ShouldResemble, input.Bounds().Size())
+	r, g, b, _ := annotated.At(1064, 904).RGBA()
+	test.That(t, []uint32{r >> 8, g >> 8, b >> 8}, test.ShouldResemble, []uint32{255, 0, 0})
+
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "debug_image", "camera_name": "cam", "edges": true})
+	test.That(t, err, test.ShouldBeNil)
+	edges := decode(res["edges"])
+	test.That(t, edges.Bounds().Dx(), test.ShouldEqual, input.Bounds().Dx()/2)
+
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "debug_image", "edges": "yes"})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestCorrelationHeatmap(t *testing.T) {
+	scale := 0.5
+	templates, err := loadTemplates(scale)
+	test.That(t, err, test.ShouldBeNil)
+	img, err := openImage("inputs/image_2.png")
+	test.That(t, err, test.ShouldBeNil)
+	imgMatrix := ImageToMatrix(img, scale)
+
+	// the surface holds the correlation of each match at the center of its window
+	template := templates[1]
+	surface := NewCorrelationSurface(len(imgMatrix[0]), len(imgMatrix))
+	matches := template.FindMatchWithSurface(imgMatrix, 2, 0.75, scale, surface)
+	test.That(t, matches, test.ShouldResemble, template.FindMatch(imgMatrix, 2, 0.75, scale))
+	test.That(t, len(matches), test.ShouldBeGreaterThan, 0)
+	for _, match := range matches {
+		x := int(float64(match.X)*scale) - template.padding + template.kernelWidth/2
+		y := int(float64(match.Y)*scale) - template.padding + template.kernelHeight/2
+		corr, ok := surface.At(x, y)
+		test.That(t, ok, test.ShouldBeTrue)
+		test.That(t, corr, test.ShouldAlmostEqual, match.Score, 1e-3)
+	}
+
+	cfg := &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: scale}
+	tf := newTestFinder(t, cfg, newTestCamera(t, "cam", "inputs/image_2.png"))
+	res, err := tf.DoCommand(context.Background(), map[string]interface{}{"command": "correlation_heatmap", "bins": 10.0})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["width"], test.ShouldEqual, len(imgMatrix[0]))
+
+	data, err := base64.StdEncoding.DecodeString(res["heatmap"].(string))
+	test.That(t, err, test.ShouldBeNil)
+	heatmap, err := png.Decode(bytes.NewReader(data))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, heatmap.Bounds().Dy(), test.ShouldEqual, len(imgMatrix))
+
+	histogram := res["histogram"].(map[string]interface{})
+	bins := histogram["bins"].([]interface{})
+	test.That(t, len(bins), test.ShouldEqual, 10)
+	total := 0
+	for _, bin := range bins {
+		total += bin.(map[string]interface{})["count"].(int)
+	}
+	test.That(t, total, test.ShouldEqual, histogram["samples"])
+	test.That(t, histogram["above_threshold"], test.ShouldBeGreaterThan, 0)
+	test.That(t, histogram["max"], test.ShouldBeGreaterThan, 0.75)
+	test.That(t, histogram["p50"], test.ShouldBeLessThan, histogram["p99"])
+}
+
+func TestOverlayCamera(t *testing.T) {
+	ctx := context.Background()
+	cfg := &OverlayCameraConfig{Camera: "cam", VisionService: "finder"}
+	deps, err := cfg.Validate("path")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, deps, test.ShouldResemble, []string{"cam", "finder"})
+	_, err = (&OverlayCameraConfig{Camera: "cam"}).Validate("path")
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = (&OverlayCameraConfig{VisionService: "finder"}).Validate("path")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	cam := newTestCamera(t, "cam", "inputs/image_1.png")
+	tf := newTestFinder(t, &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5}, cam)
+	conf := resource.Config{Name: "overlay", API: camera.API, Model: OverlayModel, ConvertedAttributes: cfg}
+	overlay, err := newOverlayCamera(ctx, resource.Dependencies{cam.Name(): cam, tf.Name(): tf}, conf, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+
+	data, metadata, err := overlay.Image(ctx, utils.MimeTypePNG, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, metadata.MimeType, test.ShouldEqual, utils.MimeTypePNG)
+	img, err := png.Decode(bytes.NewReader(data))
+	test.That(t, err, test.ShouldBeNil)
+
+	// detections are drawn in red, the rest of the frame is left as is
+	input, err := openImage("inputs/image_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	r, g, b, _ := img.At(1064, 904).RGBA()
+	test.That(t, []uint32{r >> 8, g >> 8, b >> 8}, test.ShouldResemble, []uint32{255, 0, 0})
+	test.That(t, color.RGBAModel.Convert(img.At(10, 10)), test.ShouldResemble, color.RGBAModel.Convert(input.At(10, 10)))
+
+	_, metadata, err = overlay.Image(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, metadata.MimeType, test.ShouldEqual, utils.MimeTypeJPEG)
+
+	images, _, err := overlay.Images(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(images), test.ShouldEqual, 1)
+	test.That(t, images[0].Image.Bounds(), test.ShouldResemble, input.Bounds())
+
+	// a camera the finder is not configured for is read directly and its frames searched
+	other := newTestCamera(t, "other", "inputs/image_2.png")
+	conf = resource.Config{Name: "overlay", API: camera.API, Model: OverlayModel,
+		ConvertedAttributes: &OverlayCameraConfig{Camera: "other", VisionService: "finder"}}
+	overlay, err = newOverlayCamera(ctx, resource.Dependencies{other.Name(): other, tf.Name(): tf}, conf, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+	data, _, err = overlay.Image(ctx, utils.MimeTypePNG, nil)
+	test.That(t, err, test.ShouldBeNil)
+	img, err = png.Decode(bytes.NewReader(data))
+	test.That(t, err, test.ShouldBeNil)
+	input, err = openImage("inputs/image_2.png")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, img.Bounds(), test.ShouldResemble, input.Bounds())
+	detections, err := tf.Detections(ctx, input, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, detections, test.ShouldNotBeEmpty)
+	corner := detections[0].BoundingBox().Min
+	r, g, b, _ = img.At(corner.X, corner.Y).RGBA()
+	test.That(t, []uint32{r >> 8, g >> 8, b >> 8}, test.ShouldResemble, []uint32{255, 0, 0})
+
+	// the overlay draws the detections DetectionsFromCamera returns, here only once debouncing confirmed them
+	tf = newTestFinder(t, &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5, Tracking: true, ConfirmFrames: 2}, cam)
+	conf = resource.Config{Name: "overlay", API: camera.API, Model: OverlayModel, ConvertedAttributes: cfg}
+	overlay, err = newOverlayCamera(ctx, resource.Dependencies{cam.Name(): cam, tf.Name(): tf}, conf, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+	for _, confirmed := range []bool{false, true} {
+		expireResults(tf)
+		data, _, err = overlay.Image(ctx, utils.MimeTypePNG, nil)
+		test.That(t, err, test.ShouldBeNil)
+		img, err = png.Decode(bytes.NewReader(data))
+		test.That(t, err, test.ShouldBeNil)
+		r, g, b, _ = img.At(1064, 904).RGBA()
+		test.That(t, r>>8 == 255 && g>>8 == 0 && b>>8 == 0, test.ShouldEqual, confirmed)
+	}
+}
+
+func TestTriangleSensor(t *testing.T) {
+	ctx := context.Background()
+	_, err := (&TriangleSensorConfig{}).Validate("path")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	port := newTestCamera(t, "port", "inputs/image_1.png")
+	starboard := newTestCamera(t, "starboard", "inputs/image_2.png")
+	tf := newTestFinder(t, &TriangleFinderConfig{Camera: "port", Cameras: []string{"starboard"}, Threshold: 0.75, Scale: 0.5},
+		port, starboard)
+
+	cfg := &TriangleSensorConfig{VisionService: "finder", Camera: "starboard"}
+	deps, err := cfg.Validate("path")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, deps, test.ShouldResemble, []string{"finder"})
+	conf := resource.Config{Name: "triangles", API: sensor.API, Model: SensorModel, ConvertedAttributes: cfg}
+	s, err := newTriangleSensor(ctx, resource.Dependencies{tf.Name(): tf}, conf, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+
+	readings, err := s.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	detections, err := tf.DetectionsFromCamera(ctx, "starboard", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["count"], test.ShouldEqual, len(detections))
+	test.That(t, readings["best_score"], test.ShouldEqual, detections[0].Score())
+	first := readings["detections"].([]interface{})[0].(map[string]interface{})
+	box := detections[0].BoundingBox()
+	test.That(t, first["label"], test.ShouldEqual, "triangle")
+	test.That(t, first["x_center"], test.ShouldEqual, float64(box.Min.X+box.Max.X)/2)
+	test.That(t, first["width"], test.ShouldEqual, box.Dx())
+
+	// readings must be convertible to protobuf to be captured
+	_, err = structpb.NewStruct(readings)
+	test.That(t, err, test.ShouldBeNil)
+
+	// any vision service can be used, the camera name and extra are passed to DetectionsFromCamera
+	other := inject.NewVisionService("other")
+	var gotCamera string
+	var gotExtra map[string]interface{}
+	other.DetectionsFromCameraFunc = func(ctx context.Context, cameraName string, extra map[string]interface{}) ([]objdet.Detection, error) {
+		gotCamera, gotExtra = cameraName, extra
+		return []objdet.Detection{objdet.NewDetectionWithoutImgBounds(image.Rect(10, 20, 30, 60), 0.9, "buoy")}, nil
+	}
+	// the injected DetectionsFromCamera is only called when Detections is injected too
+	other.DetectionsFunc = func(ctx context.Context, img image.Image, extra map[string]interface{}) ([]objdet.Detection, error) {
+		return nil, errUnimplemented
+	}
+	other.DoCommandFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errUnimplemented
+	}
+	conf = resource.Config{Name: "buoys", API: sensor.API, Model: SensorModel,
+		ConvertedAttributes: &TriangleSensorConfig{VisionService: "other", Camera: "bow"}}
+	s, err = newTriangleSensor(ctx, resource.Dependencies{other.Name(): other}, conf, logging.NewTestLogger(t))
+	test.That(t, err, test.ShouldBeNil)
+	readings, err = s.Readings(ctx, map[string]interface{}{"fresh": true})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, gotCamera, test.ShouldEqual, "bow")
+	test.That(t, gotExtra, test.ShouldResemble, map[string]interface{}{"fresh": true})
+	test.That(t, readings["count"], test.ShouldEqual, 1)
+	first = readings["detections"].([]interface{})[0].(map[string]interface{})
+	test.That(t, first["label"], test.ShouldEqual, "buoy")
+	test.That(t, first["y_center"], test.ShouldEqual, 40.0)
+}
+
+func TestBackgroundPolling(t *testing.T) {
+	ctx := context.Background()
+	data, err := os.ReadFile("inputs/image_2.png")
+	test.That(t, err, test.ShouldBeNil)
+	var mu sync.Mutex
+	calls, broken := 0, false
+	cam := inject.NewCamera("cam")
+	cam.ImageFunc = func(ctx context.Context, mimeType string, extra map[string]interface{}) ([]byte, camera.ImageMetadata, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if broken {
+			return nil, camera.ImageMetadata{}, errors.New("camera disconnected")
+		}
+		return data, camera.ImageMetadata{MimeType: utils.MimeTypePNG}, nil
+	}
+	cameraCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+
+	cfg := &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5, PollRateHz: 20}
+	logger, logs := logging.NewObservedTestLogger(t)
+	tf := newTestFinderWithLogger(t, logger, cfg, cam)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		tf.cacheMu.Lock()
+		_, ok := tf.cache["cam"]
+		tf.cacheMu.Unlock()
+		if ok {
+			break
+		}
+		test.That(t, time.Since(start), test.ShouldBeLessThan, time.Minute)
+	}
+
+	// requests are answered from the cache while the camera is unavailable, until the result is stale
+	mu.Lock()
+	broken = true
+	callsWhenBroken := calls
+	mu.Unlock()
+	for cameraCalls() == callsWhenBroken {
+		// wait for a poll to fail, so the cached result is not replaced anymore
+		time.Sleep(10 * time.Millisecond)
+	}
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(detections), test.ShouldEqual, 2)
+	capture, err := tf.CaptureAllFromCamera(ctx, "cam", viscapture.CaptureOptions{ReturnImage: true, ReturnDetections: true}, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, capture.Image, test.ShouldNotBeNil)
+	test.That(t, len(capture.Detections), test.ShouldEqual, 2)
+	capturedAt, err := time.Parse(time.RFC3339Nano, capture.Extra["captured_at"].(string))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, capturedAt, test.ShouldHappenBefore, time.Now())
+	res, err := tf.DoCommand(ctx, map[string]interface{}{"command": "get_latest_detections"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["count"], test.ShouldEqual, 2)
+
+	tf.cacheMu.Lock()
+	stale := *tf.cache["cam"]
+	stale.capturedAt = time.Now().Add(-time.Hour)
+	tf.cache["cam"] = &stale
+	tf.cacheMu.Unlock()
+	_, err = tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "camera disconnected")
+
+	// a failing camera is logged once, not at every poll
+	for cameraCalls() < callsWhenBroken+4 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	warnings := logs.FilterMessageSnippet("failed to poll camera").All()
+	test.That(t, len(warnings), test.ShouldEqual, 1)
+	test.That(t, warnings[0].Level.String(), test.ShouldEqual, "warn")
+	test.That(t, warnings[0].Message, test.ShouldContainSubstring, "camera disconnected")
+	mu.Lock()
+	broken = false
+	mu.Unlock()
+	for logs.FilterMessageSnippet("polling camera").Len() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// closing stops the polling
+	test.That(t, tf.Close(ctx), test.ShouldBeNil)
+	afterClose := cameraCalls()
+	time.Sleep(200 * time.Millisecond)
+	test.That(t, cameraCalls(), test.ShouldEqual, afterClose)
+}
+
+func TestTracker(t *testing.T) {
+	match := func(x, y int, label string) Match {
+		return Match{X: x, Y: y, Width: 30, Height: 30, Score: 0.8, Label: label}
+	}
+	now := time.Now()
+	tr := newTracker(trackerOptions{maxMissedFrames: 2})
+
+	first := tr.update([]Match{match(100, 100, "triangle"), match(300, 100, "triangle")}, now)
+	test.That(t, []int{first[0].id, first[1].id}, test.ShouldResemble, []int{1, 2})
+
+	// triangles moving less than their size keep their id, whatever the order of the detections
+	second := tr.update([]Match{match(310, 108, "triangle"), match(95, 90, "triangle")}, now)
+	test.That(t, []int{second[0].id, second[1].id}, test.ShouldResemble, []int{2, 1})
+	test.That(t, second[1].hits, test.ShouldEqual, 2)
+
+	// a jump larger than the triangle, or a different label, starts a new track
+	third := tr.update([]Match{match(200, 300, "triangle"), match(310, 108, "diamond")}, now)
+	test.That(t, []int{third[0].id, third[1].id}, test.ShouldResemble, []int{3, 4})
+	test.That(t, len(tr.tracks), test.ShouldEqual, 4)
+
+	// lost tracks are kept for maxMissedFrames frames
+	tr.update(nil, now)
+	test.That(t, len(tr.tracks), test.ShouldEqual, 4)
+	tr.update([]Match{match(200, 300, "triangle")}, now)
+	ids := []int{}
+	for _, track := range tr.tracks {
+		ids = append(ids, track.id)
+	}
+	test.That(t, ids, test.ShouldResemble, []int{3, 4})
+}
+
+func TestTracking(t *testing.T) {
+	ctx := context.Background()
+	cfg := &TriangleFinderConfig{
+		Camera: "cam", Threshold: 0.75, Scale: 0.5, Tracking: true, TrackIDsInLabels: true, KalmanFilter: true,
+	}
+	tf := newTestFinder(t, cfg, newTestCamera(t, "cam", "inputs/image_1.png"))
+
+	first, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	expireResults(tf)
+	second, err := tf.DetectionsFromCamera(ctx, "cam", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(second), test.ShouldEqual, 5)
+	for i := range first {
+		test.That(t, second[i].Label(), test.ShouldEqual, first[i].Label())
+		test.That(t, second[i].Label(), test.ShouldStartWith, "triangle#")
+	}
+
+	res, err := tf.DoCommand(ctx, map[string]interface{}{"command": "get_tracks"})
+	test.That(t, err, test.ShouldBeNil)
+	tracks := res["tracks"].([]interface{})
+	test.That(t, len(tracks), test.ShouldEqual, 5)
+	for _, tr := range tracks {
+		test.That(t, tr.(map[string]interface{})["hits"], test.ShouldEqual, 2)
+		smoothed := tr.(map[string]interface{})["smoothed"].(map[string]interface{})
+		test.That(t, smoothed["x_center"], test.ShouldAlmostEqual, tr.(map[string]interface{})["x_center"], 1)
+		test.That(t, smoothed["speed"], test.ShouldAlmostEqual, 0, 1)
+	}
+
+	_, err = (&TriangleFinderConfig{Camera: "cam", TrackIDsInLabels: true}).Validate("path")
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = (&TriangleFinderConfig{Camera: "cam", KalmanFilter: true}).Validate("path")
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestKalmanFilter(t *testing.T) {
+	tr := newTracker(trackerOptions{kalman: &kalmanOptions{}})
+	start := time.Now()
+
+	// a triangle moving 20 px/s right and 10 px/s down, detected 10 times a second with a few pixels of jitter
+	jitter := []int{2, -2, 1, -1, 0, 2, -1, -2, 1, 0}
+	var rawError, smoothedError float64
+	var tracked *track
+	for frame := 0; frame < 50; frame++ {
+		seconds := float64(frame) / 10
+		trueX, trueY := 100+20*seconds, 200+10*seconds
+		match := Match{
+			X: int(trueX) - 15 + jitter[frame%len(jitter)], Y: int(trueY) - 15 - jitter[(frame+3)%len(jitter)],
+			Width: 30, Height: 30, Score: 0.9, Label: "triangle",
+		}
+		tracks := tr.update([]Match{match}, start.Add(time.Duration(seconds*float64(time.Second))))
+		test.That(t, tracks[0].id, test.ShouldEqual, 1)
+		tracked = tracks[0]
+
+		if frame >= 25 {
+			x, y := tracked.center()
+			rawError += math.Hypot(x-trueX, y-trueY)
+			smoothedError += math.Hypot(tracked.filter.x.pos-trueX, tracked.filter.y.pos-trueY)
+		}
+	}
+	test.That(t, smoothedError, test.ShouldBeLessThan, rawError)
+
+	readings := tracked.filter.readings()
+	test.That(t, readings["x_velocity"], test.ShouldAlmostEqual, 20, 2)
+	test.That(t, readings["y_velocity"], test.ShouldAlmostEqual, 10, 2)
+	test.That(t, readings["speed"], test.ShouldAlmostEqual, math.Hypot(20, 10), 2)
+	// clockwise from the top of the image: right is 90 and down is 180
+	test.That(t, readings["heading"], test.ShouldAlmostEqual, 180-math.Atan2(20, 10)*180/math.Pi, 5)
+
+	// lost triangles are predicted forward
+	x := tracked.filter.x.pos
+	tr.update(nil, start.Add(6*time.Second))
+	test.That(t, tracked.filter.x.pos, test.ShouldAlmostEqual, x+20*1.1, 3)
+}
+
+func TestDebouncing(t *testing.T) {
+	match := func(x, y int) Match {
+		return Match{X: x, Y: y, Width: 30, Height: 30, Score: 0.8, Label: "triangle"}
+	}
+	ids := func(matches []Match, trackIDs []int) []int {
+		test.That(t, len(trackIDs), test.ShouldEqual, len(matches))
+		return trackIDs
+	}
+	now := time.Now()
+	tr := newTracker(trackerOptions{maxMissedFrames: 1, debounce: &debounceOptions{confirmFrames: 2, windowFrames: 3, holdFrames: 2}})
+	frame := func(matches ...Match) []int {
+		return ids(tr.debounced(matches, tr.update(matches, now)))
+	}
+
+	// a triangle is reported from its second detection, a one frame detection never is
+	test.That(t, frame(match(100, 100)), test.ShouldBeEmpty)
+	test.That(t, frame(match(102, 100), match(300, 300)), test.ShouldResemble, []int{1})
+	// a lost triangle is held for holdFrames frames at its last position, its track kept that long
+	reported, _ := tr.debounced(nil, tr.update(nil, now))
+	test.That(t, len(reported), test.ShouldEqual, 1)
+	test.That(t, reported[0].GetBoundingBox(), test.ShouldResemble, image.Rect(102, 100, 132, 130))
+	test.That(t, frame(), test.ShouldResemble, []int{1})
+	test.That(t, frame(), test.ShouldBeEmpty)
+	test.That(t, len(tr.tracks), test.ShouldEqual, 0)
+
+	// detections do not need to be consecutive, 2 out of 3 frames are enough
+	test.That(t, frame(match(200, 100)), test.ShouldBeEmpty)
+	test.That(t, frame(), test.ShouldBeEmpty)
+	test.That(t, frame(match(200, 100)), test.ShouldResemble, []int{3})
+
+	opts := (&TriangleFinderConfig{Tracking: true, ConfirmFrames: 3}).debounceOptions()
+	test.That(t, *opts, test.ShouldResemble, debounceOptions{confirmFrames: 3, windowFrames: 3})
+	test.That(t, (&TriangleFinderConfig{Tracking: true, ConfirmFrames: 1}).debounceOptions(), test.ShouldBeNil)
+
+	ctx := context.Background()
+	cfg := &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5, Tracking: true, ConfirmFrames: 2, MaxResultAgeMs: 3600000}
+	tf := newTestFinder(t, cfg, newTestCamera(t, "cam", "inputs/image_1.png"))
+
+	// frames are counted, not requests: readers of the same frame, together or one after the other, do not confirm a track
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+			test.That(t, err, test.ShouldBeNil)
+			test.That(t, detections, test.ShouldBeEmpty)
+		}()
+	}
+	wg.Wait()
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, detections, test.ShouldBeEmpty)
+	classifications, err := tf.ClassificationsFromCamera(ctx, "", 0, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, classifications[0].Label(), test.ShouldEqual, noTriangleLabel)
+	res, err := tf.DoCommand(ctx, map[string]interface{}{"command": "get_tracks"})
+	test.That(t, err, test.ShouldBeNil)
+	tracks := res["tracks"].([]interface{})
+	test.That(t, len(tracks), test.ShouldEqual, 5)
+	for _, tr := range tracks {
+		test.That(t, tr.(map[string]interface{})["hits"], test.ShouldEqual, 1)
+	}
+
+	// the next frame confirms them
+	expireResults(tf)
+	detections, err = tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(detections), test.ShouldEqual, 5)
+
+	for _, bad := range []*TriangleFinderConfig{
+		{Camera: "cam", ConfirmFrames: 2},
+		{Camera: "cam", Tracking: true, ConfirmFrames: -1},
+		{Camera: "cam", Tracking: true, ConfirmFrames: 3, ConfirmWindowFrames: 2},
+		{Camera: "cam", Tracking: true, ConfirmFrames: 3, ConfirmWindowFrames: 65},
+	} {
+		_, err = bad.Validate("path")
+		test.That(t, err, test.ShouldNotBeNil)
+	}
+}
+
+func TestSonarCalibration(t *testing.T) {
+	sonar := &SonarCalibration{ApexX: 100, ApexY: 200, MaxRangeRadius: 150, AngularSpan: 90, RangeScale: 0.1}
+	test.That(t, sonar.validate(), test.ShouldBeNil)
+
+	rangeM, bearing, inFan := sonar.polar(100, 100)
+	test.That(t, rangeM, test.ShouldAlmostEqual, 10)
+	test.That(t, bearing, test.ShouldAlmostEqual, 0)
+	test.That(t, inFan, test.ShouldBeTrue)
+	// bearings are clockwise, to starboard when the fan opens upwards
+	_, bearing, inFan = sonar.polar(150, 150)
+	test.That(t, bearing, test.ShouldAlmostEqual, 45)
+	test.That(t, inFan, test.ShouldBeTrue)
+	_, bearing, inFan = sonar.polar(0, 150)
+	test.That(t, bearing, test.ShouldAlmostEqual, -63.43, 0.01)
+	test.That(t, inFan, test.ShouldBeFalse)
+	_, _, inFan = sonar.polar(100, 40)
+	test.That(t, inFan, test.ShouldBeFalse)
+
+	// a fan opening downwards, from an apex at the top of the image
+	down := &SonarCalibration{ApexX: 100, MaxRangeRadius: 150, AngularSpan: 90, RangeScale: 0.1, Direction: 180}
+	rangeM, bearing, inFan = down.polar(90, 100)
+	test.That(t, rangeM, test.ShouldAlmostEqual, math.Hypot(10, 100)*0.1)
+	test.That(t, bearing, test.ShouldAlmostEqual, 5.71, 0.01)
+	test.That(t, inFan, test.ShouldBeTrue)
+
+	for _, bad := range []SonarCalibration{
+		{MaxRangeRadius: 150, AngularSpan: 90},
+		{MaxRangeRadius: 150, AngularSpan: 400, RangeScale: 0.1},
+		{AngularSpan: 90, RangeScale: 0.1},
+	} {
+		_, err := (&TriangleFinderConfig{Camera: "cam", SonarCalibrations: map[string]*SonarCalibration{"cam": &bad}}).Validate("path")
+		test.That(t, err, test.ShouldNotBeNil)
+	}
+	_, err := (&TriangleFinderConfig{Camera: "cam", SonarCalibrations: map[string]*SonarCalibration{"other": sonar}}).Validate("path")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// each camera has its own calibration, the starboard one has none
+	ctx := context.Background()
+	apex := &SonarCalibration{ApexX: 320, ApexY: 480, MaxRangeRadius: 480, AngularSpan: 130, RangeScale: 0.05}
+	cfg := &TriangleFinderConfig{
+		Camera: "port", Cameras: []string{"starboard"}, Threshold: 0.75, Scale: 0.5,
+		SonarCalibrations: map[string]*SonarCalibration{"port": apex},
+	}
+	_, err = cfg.Validate("path")
+	test.That(t, err, test.ShouldBeNil)
+	tf := newTestFinder(t, cfg, newTestCamera(t, "port", "inputs/image_1.png"), newTestCamera(t, "starboard", "inputs/image_2.png"))
+	res, err := tf.DoCommand(ctx, map[string]interface{}{"command": "get_latest_detections"})
+	test.That(t, err, test.ShouldBeNil)
+	detections := res["detections"].([]interface{})
+	test.That(t, detections, test.ShouldNotBeEmpty)
+	for _, det := range detections {
+		det := det.(map[string]interface{})
+		rangeM, bearing, _ := apex.polar(det["x_center"].(float64), det["y_center"].(float64))
+		test.That(t, det["range_m"], test.ShouldEqual, rangeM)
+		test.That(t, det["bearing_degrees"], test.ShouldEqual, bearing)
+		test.That(t, det, test.ShouldContainKey, "in_fan")
+	}
+	_, err = structpb.NewStruct(res)
+	test.That(t, err, test.ShouldBeNil)
+
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_latest_detections", "camera_name": "starboard"})
+	test.That(t, err, test.ShouldBeNil)
+	detections = res["detections"].([]interface{})
+	test.That(t, detections, test.ShouldNotBeEmpty)
+	test.That(t, detections[0], test.ShouldNotContainKey, "range_m")
+
+	// the calibration of each camera is returned by get_sonar_calibration, in a form that survives protobuf
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_sonar_calibration"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["camera_name"], test.ShouldEqual, "port")
+	converted, err := structpb.NewStruct(res)
+	test.That(t, err, test.ShouldBeNil)
+	parsed, err := sonarCalibrationFromAttributes(converted.AsMap()["sonar_calibration"])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, parsed, test.ShouldResemble, apex)
+	res, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_sonar_calibration", "camera_name": "starboard"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res, test.ShouldNotContainKey, "sonar_calibration")
+	_, err = tf.DoCommand(ctx, map[string]interface{}{"command": "get_sonar_calibration", "camera_name": "bow"})
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// the sensor adds the range and bearing of the calibration of its camera to the detections
+	for _, cameraName := range []string{"", "starboard"} {
+		conf := resource.Config{Name: "triangles", API: sensor.API, Model: SensorModel,
+			ConvertedAttributes: &TriangleSensorConfig{VisionService: "finder", Camera: cameraName}}
+		s, err := newTriangleSensor(ctx, resource.Dependencies{tf.Name(): tf}, conf, logging.NewTestLogger(t))
+		test.That(t, err, test.ShouldBeNil)
+		readings, err := s.Readings(ctx, nil)
+		test.That(t, err, test.ShouldBeNil)
+		first := readings["detections"].([]interface{})[0].(map[string]interface{})
+		if cameraName == "starboard" {
+			test.That(t, first, test.ShouldNotContainKey, "range_m")
+			continue
+		}
+		rangeM, bearing, _ := apex.polar(first["x_center"].(float64), first["y_center"].(float64))
+		test.That(t, first["range_m"], test.ShouldEqual, rangeM)
+		test.That(t, first["bearing_degrees"], test.ShouldEqual, bearing)
+	}
+}
+
+func TestObjectPointClouds(t *testing.T) {
+	sonar := &SonarCalibration{ApexX: 100, ApexY: 200, MaxRangeRadius: 150, AngularSpan: 90, RangeScale: 0.1}
+	pt := sonar.point(100, 100)
+	test.That(t, pt.X, test.ShouldAlmostEqual, 0)
+	test.That(t, pt.Y, test.ShouldAlmostEqual, 10000)
+	test.That(t, pt.Z, test.ShouldAlmostEqual, 0)
+	pt = sonar.point(150, 200)
+	test.That(t, pt.X, test.ShouldAlmostEqual, 5000)
+	test.That(t, pt.Y, test.ShouldAlmostEqual, 0)
+
+	// a transducer 300mm under the robot origin, turned 90 degrees to port
+	sonar.MountingPose = &SonarPose{Y: 500, Z: -300, OZ: 1, Theta: 90}
+	pt = sonar.point(100, 100)
+	test.That(t, pt.X, test.ShouldAlmostEqual, -10000)
+	test.That(t, pt.Y, test.ShouldAlmostEqual, 500)
+	test.That(t, pt.Z, test.ShouldAlmostEqual, -300)
+
+	ctx := context.Background()
+	tf := newTestFinder(t, &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5},
+		newTestCamera(t, "cam", "inputs/image_1.png"))
+	props, err := tf.GetProperties(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, props.ObjectPCDsSupported, test.ShouldBeFalse)
+	_, err = tf.GetObjectPointClouds(ctx, "", nil)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	apex := &SonarCalibration{
+		ApexX: 320, ApexY: 480, MaxRangeRadius: 480, AngularSpan: 130, RangeScale: 0.05,
+		MountingPose: &SonarPose{Z: -500},
+	}
+	tf = newTestFinder(t, &TriangleFinderConfig{
+		Camera: "cam", Threshold: 0.75, Scale: 0.5,
+		SonarCalibrations: map[string]*SonarCalibration{"cam": apex},
+	}, newTestCamera(t, "cam", "inputs/image_1.png"))
+	props, err = tf.GetProperties(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, props.ObjectPCDsSupported, test.ShouldBeTrue)
+
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	inFan := []objdet.Detection{}
+	for _, det := range detections {
+		box := det.BoundingBox()
+		if _, _, ok := apex.polar(float64(box.Min.X+box.Max.X)/2, float64(box.Min.Y+box.Max.Y)/2); ok {
+			inFan = append(inFan, det)
+		}
+	}
+	test.That(t, inFan, test.ShouldNotBeEmpty)
+
+	objects, err := tf.GetObjectPointClouds(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(objects), test.ShouldEqual, len(inFan))
+	for i, object := range objects {
+		box := inFan[i].BoundingBox()
+		center := apex.point(float64(box.Min.X+box.Max.X)/2, float64(box.Min.Y+box.Max.Y)/2)
+		test.That(t, object.Size(), test.ShouldEqual, 5)
+		_, found := object.At(center.X, center.Y, center.Z)
+		test.That(t, found, test.ShouldBeTrue)
+		test.That(t, center.Z, test.ShouldAlmostEqual, -500)
+		test.That(t, object.Geometry.Label(), test.ShouldEqual, "triangle")
+	}
+}
+
+func TestClassifications(t *testing.T) {
+	matches := []Match{
+		{Score: 0.8, Label: "triangle"},
+		{Score: 0.9, Label: "diamond"},
+		{Score: 0.95, Label: "triangle"},
+		{Score: 0.85, Label: "square"},
+	}
+	labels := func(cc classification.Classifications) []string {
+		res := []string{}
+		for _, c := range cc {
+			res = append(res, c.Label())
+		}
+		return res
+	}
+	all := classifyMatches(matches, 0.95, 0)
+	test.That(t, labels(all), test.ShouldResemble, []string{"triangle", "diamond", "square"})
+	test.That(t, all[0].Score(), test.ShouldAlmostEqual, 0.95, 1e-6)
+	test.That(t, labels(classifyMatches(matches, 0.95, 2)), test.ShouldResemble, []string{"triangle", "diamond"})
+	// no_triangle is less confident the closer the frame came to a match
+	none := classifyMatches(nil, 0.7, 3)
+	test.That(t, labels(none), test.ShouldResemble, []string{noTriangleLabel})
+	test.That(t, none[0].Score(), test.ShouldAlmostEqual, 0.3, 1e-6)
+	test.That(t, classifyMatches(nil, -0.2, 3)[0].Score(), test.ShouldEqual, 1)
+
+	ctx := context.Background()
+	tf := newTestFinder(t, &TriangleFinderConfig{Camera: "cam", Threshold: 0.75, Scale: 0.5},
+		newTestCamera(t, "cam", "inputs/image_1.png"))
+	props, err := tf.GetProperties(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, props.ClassificationSupported, test.ShouldBeTrue)
+
+	detections, err := tf.DetectionsFromCamera(ctx, "", nil)
+	test.That(t, err, test.ShouldBeNil)
+	classifications, err := tf.ClassificationsFromCamera(ctx, "", 1, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(classifications), test.ShouldEqual, 1)
+	test.That(t, classifications[0].Label(), test.ShouldEqual, "triangle")
+	test.That(t, classifications[0].Score(), test.ShouldEqual, detections[0].Score())
+
+	img, err := openImage("inputs/image_1.png")
+	test.That(t, err, test.ShouldBeNil)
+	classifications, err = tf.Classifications(ctx, img, 5, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, labels(classifications), test.ShouldResemble, []string{"triangle"})
+
+	search, err := tf.search(ctx, img)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, search.bestCorrelation, test.ShouldBeGreaterThanOrEqualTo, search.matches[0].Score)
+
+	// a blank frame has no correlation at all
+	blank := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	classifications, err = tf.Classifications(ctx, blank, 5, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, labels(classifications), test.ShouldResemble, []string{noTriangleLabel})
+	test.That(t, classifications[0].Score(), test.ShouldEqual, 1)
+
+	// triangles just under the threshold give a low no_triangle score
+	strict := newTestFinder(t, &TriangleFinderConfig{Camera: "cam", Threshold: 0.999, Scale: 0.5},
+		newTestCamera(t, "cam", "inputs/image_1.png"))
+	classifications, err = strict.Classifications(ctx, img, 5, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, labels(classifications), test.ShouldResemble, []string{noTriangleLabel})
+	test.That(t, classifications[0].Score(), test.ShouldAlmostEqual, 1-float64(search.bestCorrelation), 1e-6)
+	test.That(t, classifications[0].Score(), test.ShouldBeLessThan, 0.25)
+
+	capture, err := tf.CaptureAllFromCamera(ctx, "", viscapture.CaptureOptions{ReturnClassifications: true}, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, labels(capture.Classifications), test.ShouldResemble, []string{"triangle"})
+}
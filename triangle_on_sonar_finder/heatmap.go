@@ -0,0 +1,214 @@
+package triangle_on_sonar_finder
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// defaultHistogramBins is the number of bins of the correlation histogram returned by the heatmap command.
+const defaultHistogramBins = 20
+
+// CorrelationSurface holds, for each pixel of an image matrix, the best correlation of any template whose
+// window is centered on it. Pixels no window is centered on (because of the stride or the borders) are NaN.
+type CorrelationSurface struct {
+	mu     sync.Mutex
+	width  int
+	height int
+	values []float32
+}
+
+// NewCorrelationSurface returns an empty surface for an image matrix of the given size
+func NewCorrelationSurface(width, height int) *CorrelationSurface {
+	values := make([]float32, width*height)
+	for i := range values {
+		values[i] = float32(math.NaN())
+	}
+	return &CorrelationSurface{width: width, height: height, values: values}
+}
+
+// At returns the best correlation recorded at (x, y), false if none was.
+func (s *CorrelationSurface) At(x, y int) (float32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.values[y*s.width+x]
+	return v, !isNaN(v)
+}
+
+// recordRow records the correlations of windows centered on row y, starting at column x and stride apart.
+func (s *CorrelationSurface) recordRow(y, x, stride int, corrs []float32) {
+	if y < 0 || y >= s.height {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row := s.values[y*s.width : (y+1)*s.width]
+	for k, corr := range corrs {
+		col := x + k*stride
+		if col >= s.width {
+			break
+		}
+		if !isNaN(corr) && (isNaN(row[col]) || corr > row[col]) {
+			row[col] = corr
+		}
+	}
+}
+
+// samples returns every correlation recorded in the surface.
+func (s *CorrelationSurface) samples() []float32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var samples []float32
+	for _, v := range s.values {
+		if !isNaN(v) {
+			samples = append(samples, v)
+		}
+	}
+	return samples
+}
+
+// Image renders the surface as a heatmap, from blue for correlations of 0 or less to red for 1. Each pixel shows
+// the best correlation recorded in the stride x stride block ending at it so a strided search has no gaps,
+// pixels without any are black.
+func (s *CorrelationSurface) Image(stride int) *image.RGBA {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	for y := 0; y < s.height; y++ {
+		for x := 0; x < s.width; x++ {
+			best := float32(math.NaN())
+			for by := max(y-stride+1, 0); by <= y; by++ {
+				for bx := max(x-stride+1, 0); bx <= x; bx++ {
+					if v := s.values[by*s.width+bx]; !isNaN(v) && (isNaN(best) || v > best) {
+						best = v
+					}
+				}
+			}
+			if isNaN(best) {
+				img.SetRGBA(x, y, color.RGBA{0, 0, 0, 255})
+				continue
+			}
+			img.SetRGBA(x, y, heatColor(best))
+		}
+	}
+	return img
+}
+
+// heatColor maps a correlation to a blue, cyan, green, yellow, red color ramp.
+func heatColor(v float32) color.RGBA {
+	v = min(max(v, 0), 1) * 4
+	segment := min(int(v), 3)
+	f := uint8(255 * (v - float32(segment)))
+	switch segment {
+	case 0:
+		return color.RGBA{0, f, 255, 255} // blue to cyan
+	case 1:
+		return color.RGBA{0, 255, 255 - f, 255} // cyan to green
+	case 2:
+		return color.RGBA{f, 255, 0, 255} // green to yellow
+	default:
+		return color.RGBA{255, 255 - f, 0, 255} // yellow to red
+	}
+}
+
+func isNaN(v float32) bool {
+	return math.IsNaN(float64(v))
+}
+
+// correlationHistogram summarizes correlations: bins of equal width over [0, 1] (negative correlations
+// are counted in the first bin), percentiles, and how many are above the threshold.
+func correlationHistogram(samples []float32, bins int, threshold float32) map[string]interface{} {
+	counts := make([]int, bins)
+	aboveThreshold := 0
+	var sum float64
+	for _, v := range samples {
+		counts[min(max(int(v*float32(bins)), 0), bins-1)]++
+		if v > threshold {
+			aboveThreshold++
+		}
+		sum += float64(v)
+	}
+	binList := make([]interface{}, bins)
+	for i, count := range counts {
+		binList[i] = map[string]interface{}{
+			"min":   float64(i) / float64(bins),
+			"max":   float64(i+1) / float64(bins),
+			"count": count,
+		}
+	}
+
+	res := map[string]interface{}{
+		"samples":         len(samples),
+		"above_threshold": aboveThreshold,
+		"bins":            binList,
+	}
+	if len(samples) == 0 {
+		return res
+	}
+	sorted := append([]float32(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		return float64(sorted[int(p*float64(len(sorted)-1))])
+	}
+	res["mean"] = sum / float64(len(samples))
+	res["max"] = float64(sorted[len(sorted)-1])
+	res["p50"] = percentile(0.5)
+	res["p90"] = percentile(0.9)
+	res["p99"] = percentile(0.99)
+	return res
+}
+
+// correlationHeatmap searches the current frame of a camera exhaustively with every template and returns
+// the best correlation at each position as a heatmap image, along with a histogram of the correlations.
+func (tf *myTriangleFinder) correlationHeatmap(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	cameraName, err := cameraNameParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	bins := defaultHistogramBins
+	if value, ok := cmd["bins"]; ok {
+		if bins, err = intParam("bins", value); err != nil {
+			return nil, err
+		}
+		if bins <= 0 {
+			return nil, errors.Errorf("bins must be positive, got %d", bins)
+		}
+	}
+
+	frame, err := tf.imageFromCamera(ctx, cameraName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get image from camera")
+	}
+
+	tf.mu.RLock()
+	templates, opts := tf.templates, tf.opts
+	tf.mu.RUnlock()
+
+	imgMatrix := ImageToMatrixWithEdgeThreshold(frame, opts.scale, opts.edgeThreshold)
+	if len(imgMatrix) == 0 {
+		return nil, errors.New("image is empty")
+	}
+	width, height := len(imgMatrix[0]), len(imgMatrix)
+	opts.surface = NewCorrelationSurface(width, height)
+	opts.mode = searchExhaustive // the pyramid search does not visit every window
+	if _, err := matchTemplates(ctx, templates, newEdgeFrame(imgMatrix), opts); err != nil {
+		return nil, err
+	}
+
+	encoded, err := encodeBase64PNG(opts.surface.Image(opts.stride))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"heatmap":   encoded,
+		"mime_type": "image/png",
+		"width":     width,
+		"height":    height,
+		"histogram": correlationHistogram(opts.surface.samples(), bins, opts.threshold),
+	}, nil
+}
@@ -0,0 +1,121 @@
+package triangle_on_sonar_finder
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// defaultKalmanProcessNoise is the spectral density of the random acceleration of a triangle, in px²/s³.
+	defaultKalmanProcessNoise = 100
+	// defaultKalmanMeasurementNoise is the variance of a detected position, in px², the stride and the template
+	// scale steps make detections jitter by a couple of pixels.
+	defaultKalmanMeasurementNoise = 4
+	// initialVelocityVariance is the variance of the velocity of a new track, in (px/s)², large since it is unknown.
+	initialVelocityVariance = 1e4
+)
+
+// axisFilter is a constant velocity Kalman filter along one axis, with state (position, velocity).
+type axisFilter struct {
+	pos, vel float64
+	p        [2][2]float64 // covariance of the state
+}
+
+func newAxisFilter(pos, measurementNoise float64) axisFilter {
+	return axisFilter{pos: pos, p: [2][2]float64{{measurementNoise, 0}, {0, initialVelocityVariance}}}
+}
+
+// predict moves the state dt seconds forward, the velocity being perturbed by a white noise acceleration
+// of spectral density q.
+func (f *axisFilter) predict(dt, q float64) {
+	f.pos += f.vel * dt
+	p := f.p
+	// P = F P F' + Q with F = [[1, dt], [0, 1]] and Q = q [[dt³/3, dt²/2], [dt²/2, dt]]
+	f.p[0][0] = p[0][0] + dt*(p[0][1]+p[1][0]) + dt*dt*p[1][1] + q*dt*dt*dt/3
+	f.p[0][1] = p[0][1] + dt*p[1][1] + q*dt*dt/2
+	f.p[1][0] = p[1][0] + dt*p[1][1] + q*dt*dt/2
+	f.p[1][1] = p[1][1] + q*dt
+}
+
+// update corrects the state with a measured position of variance r.
+func (f *axisFilter) update(z, r float64) {
+	s := f.p[0][0] + r
+	k0, k1 := f.p[0][0]/s, f.p[1][0]/s
+	innovation := z - f.pos
+	f.pos += k0 * innovation
+	f.vel += k1 * innovation
+	p := f.p
+	f.p[0][0] = (1 - k0) * p[0][0]
+	f.p[0][1] = (1 - k0) * p[0][1]
+	f.p[1][0] = p[1][0] - k1*p[0][0]
+	f.p[1][1] = p[1][1] - k1*p[0][1]
+}
+
+// motionFilter smooths the center of a track with a constant velocity Kalman filter on each axis.
+type motionFilter struct {
+	x, y       axisFilter
+	lastUpdate time.Time
+}
+
+// kalmanOptions are the noise levels of the motion filter.
+type kalmanOptions struct {
+	processNoise     float64 // px²/s³, defaultKalmanProcessNoise if 0
+	measurementNoise float64 // px², defaultKalmanMeasurementNoise if 0
+}
+
+func (opts kalmanOptions) withDefaults() kalmanOptions {
+	if opts.processNoise <= 0 {
+		opts.processNoise = defaultKalmanProcessNoise
+	}
+	if opts.measurementNoise <= 0 {
+		opts.measurementNoise = defaultKalmanMeasurementNoise
+	}
+	return opts
+}
+
+func newMotionFilter(x, y float64, at time.Time, opts kalmanOptions) *motionFilter {
+	return &motionFilter{
+		x:          newAxisFilter(x, opts.measurementNoise),
+		y:          newAxisFilter(y, opts.measurementNoise),
+		lastUpdate: at,
+	}
+}
+
+// predict moves the filter forward to the given time.
+func (f *motionFilter) predict(at time.Time, opts kalmanOptions) {
+	dt := at.Sub(f.lastUpdate).Seconds()
+	if dt <= 0 {
+		return
+	}
+	f.x.predict(dt, opts.processNoise)
+	f.y.predict(dt, opts.processNoise)
+	f.lastUpdate = at
+}
+
+// update moves the filter forward to the time of a detection and corrects it with the detected center.
+func (f *motionFilter) update(x, y float64, at time.Time, opts kalmanOptions) {
+	f.predict(at, opts)
+	f.x.update(x, opts.measurementNoise)
+	f.y.update(y, opts.measurementNoise)
+}
+
+// heading returns the direction of the velocity in degrees clockwise from the top of the image, in [0, 360).
+func (f *motionFilter) heading() float64 {
+	heading := math.Atan2(f.x.vel, -f.y.vel) * 180 / math.Pi
+	if heading < 0 {
+		heading += 360
+	}
+	return heading
+}
+
+// readings returns the smoothed center, the velocity and speed in pixels per second, and the heading of the filter.
+func (f *motionFilter) readings() map[string]interface{} {
+	return map[string]interface{}{
+		"x_center":   f.x.pos,
+		"y_center":   f.y.pos,
+		"x_velocity": f.x.vel,
+		"y_velocity": f.y.vel,
+		"speed":      math.Hypot(f.x.vel, f.y.vel),
+		"heading":    f.heading(),
+	}
+}
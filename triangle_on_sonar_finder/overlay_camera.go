@@ -0,0 +1,167 @@
+package triangle_on_sonar_finder
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/pkg/errors"
+	"go.viam.com/rdk/components/camera"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/pointcloud"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/rimage"
+	"go.viam.com/rdk/services/vision"
+	rdkutils "go.viam.com/rdk/utils"
+	objdet "go.viam.com/rdk/vision/objectdetection"
+	"go.viam.com/rdk/vision/viscapture"
+)
+
+const (
+	OverlayModelName = "triangle-overlay"
+)
+
+var OverlayModel = resource.NewModel("viam", "camera", OverlayModelName)
+
+func init() {
+	resource.RegisterComponent(camera.API, OverlayModel, resource.Registration[camera.Camera, *OverlayCameraConfig]{
+		Constructor: newOverlayCamera,
+	})
+}
+
+// OverlayCameraConfig contains the configuration for the camera drawing the detections of a triangle finder.
+type OverlayCameraConfig struct {
+	// Camera is the name of the camera whose frames are annotated.
+	Camera string `json:"camera_name"`
+
+	// VisionService is the name of the triangle finder (or any vision service) whose detections are drawn.
+	VisionService string `json:"vision_service"`
+}
+
+// Validate checks the config and returns the camera and the vision service as dependencies.
+func (cfg OverlayCameraConfig) Validate(path string) ([]string, error) {
+	if cfg.Camera == "" {
+		return nil, resource.NewConfigValidationFieldRequiredError(path, "camera_name")
+	}
+	if cfg.VisionService == "" {
+		return nil, resource.NewConfigValidationFieldRequiredError(path, "vision_service")
+	}
+	return []string{cfg.Camera, cfg.VisionService}, nil
+}
+
+// overlayCamera returns the frames of a camera with the detections of a vision service drawn on them.
+type overlayCamera struct {
+	resource.AlwaysRebuild
+
+	name       resource.Name
+	logger     logging.Logger
+	cam        camera.Camera
+	cameraName string
+	finder     vision.Service
+}
+
+func newOverlayCamera(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (camera.Camera, error) {
+	overlayConf, err := resource.NativeConfig[*OverlayCameraConfig](conf)
+	if err != nil {
+		return nil, errors.Errorf("failed to parse config for %s got: %s", OverlayModelName, err)
+	}
+	cam, err := camera.FromDependencies(deps, overlayConf.Camera)
+	if err != nil {
+		return nil, errors.Errorf("failed to get camera from dependencies for %s got: %s", OverlayModelName, err)
+	}
+	finder, err := vision.FromDependencies(deps, overlayConf.VisionService)
+	if err != nil {
+		return nil, errors.Errorf("failed to get vision service from dependencies for %s got: %s", OverlayModelName, err)
+	}
+	return &overlayCamera{
+		name:       conf.ResourceName(),
+		logger:     logger,
+		cam:        cam,
+		cameraName: overlayConf.Camera,
+		finder:     finder,
+	}, nil
+}
+
+func (oc *overlayCamera) Name() resource.Name {
+	return oc.name
+}
+
+// annotatedFrame gets a frame of the camera and draws its detections on it. If the vision service captures
+// the camera itself, the frame and its detections come from CaptureAllFromCamera, so they are the detections
+// DetectionsFromCamera returns, after tracking and debouncing. Otherwise the frame is read from the camera and
+// searched with Detections.
+func (oc *overlayCamera) annotatedFrame(ctx context.Context, extra map[string]interface{}) (image.Image, error) {
+	capture, err := oc.finder.CaptureAllFromCamera(ctx, oc.cameraName,
+		viscapture.CaptureOptions{ReturnImage: true, ReturnDetections: true}, extra)
+	if err == nil && capture.Image != nil {
+		return drawDetections(capture.Image, capture.Detections), nil
+	}
+	if err != nil {
+		oc.logger.Debugf("cannot capture %q with the vision service, reading it directly: %s", oc.cameraName, err)
+	}
+
+	frame, err := camera.DecodeImageFromCamera(ctx, rdkutils.MimeTypeJPEG, extra, oc.cam)
+	if err != nil {
+		return nil, errors.Errorf("failed to get and decode image for %s got: %s", OverlayModelName, err)
+	}
+	detections, err := oc.finder.Detections(ctx, frame, extra)
+	if err != nil {
+		return nil, errors.Errorf("failed to get detections for %s got: %s", OverlayModelName, err)
+	}
+	return drawDetections(frame, detections), nil
+}
+
+func (oc *overlayCamera) Image(ctx context.Context, mimeType string, extra map[string]interface{}) ([]byte, camera.ImageMetadata, error) {
+	img, err := oc.annotatedFrame(ctx, extra)
+	if err != nil {
+		return nil, camera.ImageMetadata{}, err
+	}
+	mimeType, _ = rdkutils.CheckLazyMIMEType(mimeType)
+	if mimeType != rdkutils.MimeTypePNG {
+		mimeType = rdkutils.MimeTypeJPEG
+	}
+	data, err := rimage.EncodeImage(ctx, img, mimeType)
+	if err != nil {
+		return nil, camera.ImageMetadata{}, errors.Errorf("failed to encode image for %s got: %s", OverlayModelName, err)
+	}
+	return data, camera.ImageMetadata{MimeType: mimeType}, nil
+}
+
+func (oc *overlayCamera) Images(ctx context.Context) ([]camera.NamedImage, resource.ResponseMetadata, error) {
+	img, err := oc.annotatedFrame(ctx, nil)
+	if err != nil {
+		return nil, resource.ResponseMetadata{}, err
+	}
+	return []camera.NamedImage{{Image: img, SourceName: oc.name.ShortName()}}, resource.ResponseMetadata{}, nil
+}
+
+func (oc *overlayCamera) NextPointCloud(ctx context.Context) (pointcloud.PointCloud, error) {
+	return nil, errUnimplemented
+}
+
+func (oc *overlayCamera) Properties(ctx context.Context) (camera.Properties, error) {
+	return camera.Properties{
+		SupportsPCD: false,
+		ImageType:   camera.ColorStream,
+		MimeTypes:   []string{rdkutils.MimeTypeJPEG, rdkutils.MimeTypePNG},
+	}, nil
+}
+
+func (oc *overlayCamera) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	return nil, errUnimplemented
+}
+
+func (oc *overlayCamera) Close(ctx context.Context) error {
+	return nil
+}
+
+// drawDetections returns a copy of the image with the bounding box and score of each detection drawn in red.
+func drawDetections(img image.Image, detections []objdet.Detection) *image.RGBA {
+	annotated := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(annotated, annotated.Bounds(), img, img.Bounds().Min, draw.Src)
+	for _, det := range detections {
+		DrawBoundingBox(annotated, *det.BoundingBox(), color.RGBA{255, 0, 0, 255}, 2, float32(det.Score())) // red, thickness 2
+	}
+	return annotated
+}
@@ -0,0 +1,235 @@
+package triangle_on_sonar_finder
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+)
+
+// defaultStalePolls is the number of polls (or searches without polling) after which a cached result is stale,
+// when max_result_age_ms is not set.
+const defaultStalePolls = 3
+
+// frameResult is the result of searching a camera frame for triangles.
+type frameResult struct {
+	img             image.Image
+	matches         []Match // matches to report, only those of confirmed tracks if debouncing is enabled
+	capturedAt      time.Time
+	searchTime      time.Duration // time taken to get and search the frame
+	bestCorrelation float32       // best correlation of any window of the frame, even below the threshold
+	trackIDs        []int         // id of the track of each match, nil if tracking is disabled
+}
+
+// poller searches the frames of every configured camera in the background, so requests for a camera
+// are answered from its latest result instead of each running their own search.
+type poller struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// pollInterval returns the time between two polls of a camera, 0 if polling is disabled.
+func (cfg *TriangleFinderConfig) pollInterval() time.Duration {
+	if cfg.PollRateHz <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / cfg.PollRateHz)
+}
+
+// maxResultAge returns how old a cached result can be and still be returned. By default a result is stale after
+// 3 polls, a poll taking the poll interval or as long as the search if the search is slower or polling is disabled.
+func (cfg *TriangleFinderConfig) maxResultAge(result *frameResult) time.Duration {
+	if cfg.MaxResultAgeMs > 0 {
+		return time.Duration(cfg.MaxResultAgeMs) * time.Millisecond
+	}
+	return defaultStalePolls * max(cfg.pollInterval(), result.searchTime)
+}
+
+// startPolling starts polling the cameras of the config, if it enables polling. Results cached with
+// previous settings are dropped.
+func (tf *myTriangleFinder) startPolling(cfg *TriangleFinderConfig) {
+	tf.stopPolling()
+
+	tf.cacheMu.Lock()
+	tf.cache = map[string]*frameResult{}
+	tf.cacheMu.Unlock()
+
+	interval := cfg.pollInterval()
+	if interval == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &poller{cancel: cancel}
+	for _, name := range cfg.cameraNames() {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			tf.pollCamera(ctx, name, interval)
+		}()
+	}
+	tf.poller = p
+}
+
+// resetResults drops the results and the tracks found with previous settings, and restarts polling with cfg.
+func (tf *myTriangleFinder) resetResults(cfg *TriangleFinderConfig) {
+	tf.resetTrackers()
+	tf.startPolling(cfg)
+}
+
+// stopPolling stops the background polling and waits for searches in progress to finish.
+func (tf *myTriangleFinder) stopPolling() {
+	if tf.poller == nil {
+		return
+	}
+	tf.poller.cancel()
+	tf.poller.wg.Wait()
+	tf.poller = nil
+}
+
+// pollCamera searches a frame of the camera every interval until ctx is cancelled. Searches that take
+// longer than the interval delay the next one rather than piling up. A camera starting to fail is logged
+// once, not at every poll, as is its recovery.
+func (tf *myTriangleFinder) pollCamera(ctx context.Context, cameraName string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		unlock, err := tf.lockCamera(ctx, cameraName)
+		if err != nil {
+			return
+		}
+		_, err = tf.searchCamera(ctx, cameraName)
+		unlock()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if !failing {
+				tf.logger.Warnf("failed to poll camera %q, retrying every %s: %s", cameraName, interval, err)
+				failing = true
+			}
+		} else if failing {
+			tf.logger.Infof("polling camera %q again", cameraName)
+			failing = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lockCamera waits until no other search of the camera is running, and returns the function ending the search.
+// Searches of a camera are serialized so that each frame feeds its tracker once, in the order they were captured.
+func (tf *myTriangleFinder) lockCamera(ctx context.Context, cameraName string) (func(), error) {
+	tf.cacheMu.Lock()
+	slot, ok := tf.searching[cameraName]
+	if !ok {
+		slot = make(chan struct{}, 1)
+		tf.searching[cameraName] = slot
+	}
+	tf.cacheMu.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// searchCamera gets a new frame from the named camera, searches it for triangles, feeds them to the tracker of
+// the camera and caches the result, so that every request for the camera shares it while it is recent enough.
+// The name must not be empty since the tracks of each camera are kept under its name, and the camera must be
+// locked.
+func (tf *myTriangleFinder) searchCamera(ctx context.Context, cameraName string) (*frameResult, error) {
+	start := time.Now()
+	img, err := tf.imageFromCamera(ctx, cameraName)
+	if err != nil {
+		return nil, err
+	}
+	capturedAt := time.Now()
+	search, err := tf.search(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	tf.recordScales(search.matches)
+	matches, trackIDs := tf.trackMatches(cameraName, search.matches, capturedAt)
+	result := &frameResult{
+		img:             img,
+		matches:         matches,
+		capturedAt:      capturedAt,
+		searchTime:      time.Since(start),
+		trackIDs:        trackIDs,
+		bestCorrelation: search.bestCorrelation,
+	}
+	tf.cacheMu.Lock()
+	tf.cache[cameraName] = result
+	tf.cacheMu.Unlock()
+	return result, nil
+}
+
+// cameraConfig returns the name of the camera, the default camera if empty, and the current config.
+func (tf *myTriangleFinder) cameraConfig(cameraName string) (string, *TriangleFinderConfig) {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	if cameraName == "" {
+		cameraName = tf.defaultCam
+	}
+	return cameraName, tf.config
+}
+
+// latestResult returns the latest result of the named camera: the cached one if it is recent enough,
+// else the result of a new search. Requests waiting for the same search share its result.
+func (tf *myTriangleFinder) latestResult(ctx context.Context, cameraName string) (*frameResult, error) {
+	cameraName, cfg := tf.cameraConfig(cameraName)
+	if cached := tf.recentResult(cameraName, cfg); cached != nil {
+		return cached, nil
+	}
+	// unknown cameras are rejected before a search slot is made for them
+	if _, err := tf.getCamera(cameraName); err != nil {
+		return nil, err
+	}
+
+	unlock, err := tf.lockCamera(ctx, cameraName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// the poller or another request may have searched a new frame while waiting
+	if cached := tf.recentResult(cameraName, cfg); cached != nil {
+		return cached, nil
+	}
+	return tf.searchCamera(ctx, cameraName)
+}
+
+// recentResult returns the cached result of the camera if it is recent enough to be returned, else nil.
+func (tf *myTriangleFinder) recentResult(cameraName string, cfg *TriangleFinderConfig) *frameResult {
+	tf.cacheMu.Lock()
+	defer tf.cacheMu.Unlock()
+	cached, ok := tf.cache[cameraName]
+	if !ok || time.Since(cached.capturedAt) > cfg.maxResultAge(cached) {
+		return nil
+	}
+	return cached
+}
+
+// latestDetections returns the latest detections of a camera, as sensor readings with their range and bearing
+// if the sonar is calibrated, and when its frame was captured.
+func (tf *myTriangleFinder) latestDetections(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	cameraName, err := cameraNameParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	cameraName, cfg := tf.cameraConfig(cameraName)
+	result, err := tf.latestResult(ctx, cameraName)
+	if err != nil {
+		return nil, err
+	}
+	res := detectionReadings(result.detections(tf.trackIDsInLabels()), cfg.SonarCalibrations[cameraName])
+	res["captured_at"] = result.capturedAt.Format(time.RFC3339Nano)
+	res["age_ms"] = time.Since(result.capturedAt).Milliseconds()
+	return res, nil
+}
@@ -0,0 +1,200 @@
+package triangle_on_sonar_finder
+
+import (
+	"fmt"
+	"math"
+)
+
+// searchMode selects how templates are searched for in a frame.
+type searchMode string
+
+const (
+	// searchExhaustive correlates every template with every window of the frame.
+	searchExhaustive searchMode = "exhaustive"
+	// searchPyramid finds candidates on a downsampled frame and only refines their neighborhoods at full resolution.
+	searchPyramid searchMode = "pyramid"
+)
+
+const (
+	// defaultPyramidLevels is the number of times the frame is halved for the coarse pass of the pyramid search.
+	defaultPyramidLevels = 2
+	// defaultCandidateRatio is the fraction of the threshold a coarse window must reach to be refined, coarse
+	// correlations are lower than full resolution ones since the edges get blurred by the downsampling.
+	defaultCandidateRatio = 0.7
+	// minCoarseKernelSize is the smallest width or height a template is downsampled to, smaller kernels
+	// correlate with almost anything.
+	minCoarseKernelSize = 4
+)
+
+// parseSearchMode returns the search mode named in the config, exhaustive if empty.
+func parseSearchMode(name string) (searchMode, error) {
+	switch mode := searchMode(name); mode {
+	case "":
+		return searchExhaustive, nil
+	case searchExhaustive, searchPyramid:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown search_mode %q, expected %q or %q", name, searchExhaustive, searchPyramid)
+	}
+}
+
+// buildPyramid returns the frame followed by levels successively halved copies of it.
+func buildPyramid(frame *edgeFrame, levels int) []*edgeFrame {
+	pyramid := []*edgeFrame{frame}
+	for level := 0; level < levels; level++ {
+		data := downsampleMatrix(pyramid[level].data)
+		if len(data) == 0 || len(data[0]) == 0 {
+			break
+		}
+		pyramid = append(pyramid, newEdgeFrame(data))
+	}
+	return pyramid
+}
+
+// downsampleMatrix halves a matrix in both dimensions, each value being the mean of a 2x2 block.
+func downsampleMatrix(m [][]float64) [][]float64 {
+	height := len(m) / 2
+	if height == 0 {
+		return nil
+	}
+	width := len(m[0]) / 2
+	out := make([][]float64, height)
+	for y := range out {
+		out[y] = make([]float64, width)
+		for x := range out[y] {
+			out[y][x] = (m[2*y][2*x] + m[2*y][2*x+1] + m[2*y+1][2*x] + m[2*y+1][2*x+1]) / 4
+		}
+	}
+	return out
+}
+
+// downsample returns a copy of the template with its kernel halved in both dimensions, for the coarse pass.
+func (t *TemplateFromImage) downsample() *TemplateFromImage {
+	kernel := downsampleMatrix(t.kernel)
+	height := len(kernel)
+	width := 0
+	if height > 0 {
+		width = len(kernel[0])
+	}
+
+	// the mean is ~0 after averaging a zero mean kernel, subtract what is left so the correlation stays normalized
+	var sum float64
+	for _, row := range kernel {
+		for _, v := range row {
+			sum += v
+		}
+	}
+	mean := sum / math.Max(float64(width*height), 1)
+
+	var sumKernel float32
+	var zeroMeanSum float64
+	for _, row := range kernel {
+		for x := range row {
+			row[x] -= mean
+			sumKernel += float32(row[x]) * float32(row[x])
+			zeroMeanSum += row[x]
+		}
+	}
+
+	coarse := *t
+	coarse.kernel = kernel
+	coarse.kernelWidth = width
+	coarse.kernelHeight = height
+	coarse.sumKernel = sumKernel
+	coarse.kernelSum = zeroMeanSum
+	return &coarse
+}
+
+// findMatchPyramid finds candidate windows of a downsampled template in the coarsest usable level of the
+// pyramid, then searches the neighborhood of each candidate at full resolution with a stride of 1.
+func (t *TemplateFromImage) findMatchPyramid(pyramid []*edgeFrame, opts matchOptions) []Match {
+	coarse, level := t, 0
+	for level < len(pyramid)-1 {
+		next := coarse.downsample()
+		if next.kernelWidth < minCoarseKernelSize || next.kernelHeight < minCoarseKernelSize {
+			break
+		}
+		coarse = next
+		level++
+	}
+	fine := pyramid[0]
+	if level == 0 {
+		return t.findMatchInFrame(fine, opts)
+	}
+
+	factor := 1 << level
+	coarseFrame := pyramid[level]
+	candidateThreshold := opts.candidateThreshold
+	if candidateThreshold <= 0 {
+		candidateThreshold = opts.threshold * defaultCandidateRatio
+	}
+
+	// correlate the coarse template with every window of the coarse frame
+	rows := coarseFrame.height - coarse.kernelHeight
+	cols := coarseFrame.width - coarse.kernelWidth
+	if rows <= 0 || cols <= 0 {
+		return nil
+	}
+	surface := make([]float32, rows*cols)
+	best, found := float32(0), false
+	for ci := 0; ci < rows; ci++ {
+		for cj := 0; cj < cols; cj++ {
+			if corr, ok := coarse.correlationAt(coarseFrame, ci, cj, coarse.spatialProduct(coarseFrame, ci, cj)); ok {
+				surface[ci*cols+cj] = corr
+				if !found || corr > best {
+					best, found = corr, true
+				}
+			}
+		}
+	}
+	// coarse correlations are recorded too, so a frame without any candidate still has a best correlation
+	if opts.best != nil && found {
+		opts.best.record(best)
+	}
+
+	maxRow := fine.height - t.kernelHeight - 1
+	maxCol := fine.width - t.kernelWidth - 1
+	visited := make([]bool, fine.height*fine.width)
+
+	var matches []Match
+	for ci := 0; ci < rows; ci++ {
+		for cj := 0; cj < cols; cj++ {
+			// only refine local maxima, their neighborhood covers the full resolution peak
+			corr := surface[ci*cols+cj]
+			if corr <= candidateThreshold || !isLocalMax(surface, rows, cols, ci, cj) {
+				continue
+			}
+
+			// refine around the full resolution position of the candidate
+			for i := max(ci*factor-factor, 0); i <= min(ci*factor+factor, maxRow); i++ {
+				for j := max(cj*factor-factor, 0); j <= min(cj*factor+factor, maxCol); j++ {
+					if visited[i*fine.width+j] {
+						continue
+					}
+					visited[i*fine.width+j] = true
+					corr, ok := t.correlationAt(fine, i, j, t.spatialProduct(fine, i, j))
+					if ok && corr > opts.threshold {
+						matches = append(matches, t.matchAt(i, j, corr, opts.scale))
+					}
+					if ok && opts.best != nil {
+						opts.best.record(corr)
+					}
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// isLocalMax returns true if no value in the 3x3 neighborhood of (i, j) is greater than the value at (i, j).
+func isLocalMax(surface []float32, rows, cols, i, j int) bool {
+	v := surface[i*cols+j]
+	for y := max(i-1, 0); y <= min(i+1, rows-1); y++ {
+		for x := max(j-1, 0); x <= min(j+1, cols-1); x++ {
+			if surface[y*cols+x] > v {
+				return false
+			}
+		}
+	}
+	return true
+}
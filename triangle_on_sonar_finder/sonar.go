@@ -0,0 +1,203 @@
+package triangle_on_sonar_finder
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+
+	"github.com/golang/geo/r3"
+	"github.com/pkg/errors"
+	pc "go.viam.com/rdk/pointcloud"
+	"go.viam.com/rdk/spatialmath"
+	vis "go.viam.com/rdk/vision"
+)
+
+// SonarCalibration describes where the fan of a sonar display is in the camera images, to convert image
+// positions to ranges and bearings from the transducer.
+type SonarCalibration struct {
+	// ApexX and ApexY are the image pixel of the apex of the fan, where the transducer is.
+	ApexX float64 `json:"apex_x"`
+	ApexY float64 `json:"apex_y"`
+
+	// MaxRangeRadius is the radius, in image pixels, of the arc at the maximum range of the sonar.
+	MaxRangeRadius float64 `json:"max_range_radius_px"`
+
+	// AngularSpan is the angle, in degrees, between the two edges of the fan.
+	AngularSpan float64 `json:"angular_span_degrees"`
+
+	// RangeScale is the range, in meters, of one image pixel away from the apex.
+	RangeScale float64 `json:"range_scale"`
+
+	// Direction is the direction of the center line of the fan in the image, in degrees clockwise from the
+	// top of the image. 0 if the fan opens upwards from its apex, 180 if it opens downwards.
+	Direction float64 `json:"direction_degrees,omitempty"`
+
+	// MountingPose is the pose of the transducer in the robot frame, used to place the detections in 3D.
+	// Detections are placed in the frame of the transducer if not set.
+	MountingPose *SonarPose `json:"mounting_pose,omitempty"`
+}
+
+// SonarPose is a pose in millimeters with an orientation vector in degrees, as in the frame system.
+// The frame of the transducer has +Y along the center line of the fan, +X to its right and +Z up.
+type SonarPose struct {
+	X     float64 `json:"x,omitempty"`
+	Y     float64 `json:"y,omitempty"`
+	Z     float64 `json:"z,omitempty"`
+	OX    float64 `json:"o_x,omitempty"`
+	OY    float64 `json:"o_y,omitempty"`
+	OZ    float64 `json:"o_z,omitempty"`
+	Theta float64 `json:"theta,omitempty"`
+}
+
+// pose returns the pose, the orientation defaulting to the identity if its vector is not set.
+func (p *SonarPose) pose() spatialmath.Pose {
+	orientation := &spatialmath.OrientationVectorDegrees{OX: p.OX, OY: p.OY, OZ: p.OZ, Theta: p.Theta}
+	if p.OX == 0 && p.OY == 0 && p.OZ == 0 {
+		orientation.OZ = 1
+	}
+	return spatialmath.NewPose(r3.Vector{X: p.X, Y: p.Y, Z: p.Z}, orientation)
+}
+
+func (c *SonarCalibration) validate() error {
+	if c.MaxRangeRadius <= 0 {
+		return errors.Errorf("max_range_radius_px must be positive, got %v", c.MaxRangeRadius)
+	}
+	if c.AngularSpan <= 0 || c.AngularSpan > 360 {
+		return errors.Errorf("angular_span_degrees must be between 0 and 360, got %v", c.AngularSpan)
+	}
+	if c.RangeScale <= 0 {
+		return errors.Errorf("range_scale must be positive, got %v", c.RangeScale)
+	}
+	return nil
+}
+
+// attributes returns the calibration as its config attributes, to be returned by a command.
+func (c *SonarCalibration) attributes() (map[string]interface{}, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var attributes map[string]interface{}
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// sonarCalibrationFromAttributes parses and validates a calibration returned by the get_sonar_calibration command.
+func sonarCalibrationFromAttributes(attributes interface{}) (*SonarCalibration, error) {
+	data, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, err
+	}
+	var c SonarCalibration
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.Wrap(err, "invalid sonar calibration")
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// polar converts an image position to its range in meters and bearing in degrees from the transducer,
+// the bearing being clockwise from the center line of the fan, in (-180, 180]. It also returns whether
+// the position is inside the fan.
+func (c *SonarCalibration) polar(x, y float64) (float64, float64, bool) {
+	dx, dy := x-c.ApexX, y-c.ApexY
+	radius := math.Hypot(dx, dy)
+	bearing := math.Atan2(dx, -dy)*180/math.Pi - c.Direction
+	bearing = math.Mod(bearing, 360)
+	if bearing > 180 {
+		bearing -= 360
+	} else if bearing <= -180 {
+		bearing += 360
+	}
+	inFan := radius <= c.MaxRangeRadius && math.Abs(bearing) <= c.AngularSpan/2
+	return radius * c.RangeScale, bearing, inFan
+}
+
+// addPolarReadings adds the range, bearing and whether it is inside the fan of a position to its readings.
+func (c *SonarCalibration) addPolarReadings(readings map[string]interface{}, x, y float64) {
+	rangeM, bearing, inFan := c.polar(x, y)
+	readings["range_m"] = rangeM
+	readings["bearing_degrees"] = bearing
+	readings["in_fan"] = inFan
+}
+
+// point returns the 3D position, in millimeters in the robot frame (or the transducer frame without a mounting pose),
+// of an image position. The sonar does not measure elevation, so the position is placed in the plane of the fan.
+func (c *SonarCalibration) point(x, y float64) r3.Vector {
+	rangeM, bearing, _ := c.polar(x, y)
+	bearing *= math.Pi / 180
+	pt := r3.Vector{X: rangeM * 1000 * math.Sin(bearing), Y: rangeM * 1000 * math.Cos(bearing)}
+	if c.MountingPose == nil {
+		return pt
+	}
+	return spatialmath.Compose(c.MountingPose.pose(), spatialmath.NewPoseFromPoint(pt)).Point()
+}
+
+// sonarCalibration returns the name of a camera, the default camera if not given, and its calibration under
+// "sonar_calibration" if it has one, so that users of the detections of the camera can locate them too.
+func (tf *myTriangleFinder) sonarCalibration(cmd map[string]interface{}) (map[string]interface{}, error) {
+	cameraName, err := cameraNameParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	cameraName, cfg := tf.cameraConfig(cameraName)
+	if _, err := tf.getCamera(cameraName); err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{"camera_name": cameraName}
+	if sonar, ok := cfg.SonarCalibrations[cameraName]; ok {
+		if res["sonar_calibration"], err = sonar.attributes(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// objects places the detections of the latest frame of a camera that are inside the fan in the robot frame.
+// Each object is the point cloud of the center and corners of its bounding box, and its geometry the box
+// enclosing them.
+func (tf *myTriangleFinder) objects(ctx context.Context, cameraName string) ([]*vis.Object, error) {
+	cameraName, cfg := tf.cameraConfig(cameraName)
+	if _, err := tf.getCamera(cameraName); err != nil {
+		return nil, err
+	}
+	sonar, ok := cfg.SonarCalibrations[cameraName]
+	if !ok {
+		return nil, errors.Errorf("camera %q has no sonar_calibrations entry", cameraName)
+	}
+	result, err := tf.latestResult(ctx, cameraName)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []*vis.Object{}
+	for _, det := range result.detections(tf.trackIDsInLabels()) {
+		box := det.BoundingBox()
+		x, y := float64(box.Min.X+box.Max.X)/2, float64(box.Min.Y+box.Max.Y)/2
+		if _, _, inFan := sonar.polar(x, y); !inFan {
+			continue
+		}
+		cloud := pc.New()
+		for _, corner := range [][2]float64{
+			{x, y},
+			{float64(box.Min.X), float64(box.Min.Y)},
+			{float64(box.Max.X), float64(box.Min.Y)},
+			{float64(box.Min.X), float64(box.Max.Y)},
+			{float64(box.Max.X), float64(box.Max.Y)},
+		} {
+			if err := cloud.Set(sonar.point(corner[0], corner[1]), pc.NewBasicData()); err != nil {
+				return nil, err
+			}
+		}
+		object, err := vis.NewObjectWithLabel(cloud, det.Label(), nil)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
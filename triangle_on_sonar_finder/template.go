@@ -8,6 +8,7 @@ import (
 	"image/png"
 	"math"
 	"os"
+	"sync"
 
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/basicfont"
@@ -16,19 +17,38 @@ import (
 	"github.com/nfnt/resize"
 )
 
+const (
+	// defaultLabel is the class label of templates that don't have one.
+	defaultLabel = "triangle"
+	// defaultEdgeThreshold is the Sobel gradient magnitude below which edges are dropped as noise.
+	defaultEdgeThreshold = 50
+	// maxEdgeThreshold is the largest Sobel gradient magnitude of an 8 bit image, sqrt(2) * 4 * 255.
+	maxEdgeThreshold = 1442
+)
+
 // TemplateFromImage represents a template created from an image
 type TemplateFromImage struct {
+	name           string // file the template was created from
+	label          string // class of the marker the template shows, reported as the detection label
 	kernel         [][]float64
 	kernelWidth    int
 	kernelHeight   int
 	sumKernel      float32
+	kernelSum      float64 // sum of the mean-subtracted kernel, ~0 but kept for exactness
 	originalWidth  int
 	originalHeight int
 	padding        int
+	scaleFactor    float64 // size of the template relative to the image scale
 }
 
 // NewTemplateFromImage creates a new template from an image file (including preprocessing steps)
 func NewTemplateFromImage(img image.Image, scale float64) (*TemplateFromImage, error) {
+	return NewTemplateFromImageWithEdgeThreshold(img, scale, defaultEdgeThreshold)
+}
+
+// NewTemplateFromImageWithEdgeThreshold creates a new template from an image file, dropping edges
+// weaker than edgeThreshold
+func NewTemplateFromImageWithEdgeThreshold(img image.Image, scale float64, edgeThreshold int) (*TemplateFromImage, error) {
 	originalWidth := img.Bounds().Dx()
 	originalHeight := img.Bounds().Dy()
 	resizedWidth := uint(float64(originalWidth) * scale) // finding new width using same scale as img for resizing
@@ -66,7 +86,7 @@ func NewTemplateFromImage(img image.Image, scale float64) (*TemplateFromImage, e
 	}
 
 	//step 4: applying sobel edge detection
-	edgeMatrix := sobelEdge(kernel, width, height, 50)
+	edgeMatrix := sobelEdge(kernel, width, height, int16(edgeThreshold))
 	edgeKernel := edgeMatrix
 
 	// we do the mean so we're looking for shapes, not color similarity
@@ -87,75 +107,192 @@ func NewTemplateFromImage(img image.Image, scale float64) (*TemplateFromImage, e
 	}
 
 	var sumKernel float32 = 0
+	var zeroMeanSum float64 = 0
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
 			sumKernel += float32(edgeKernel[y][x]) * float32(edgeKernel[y][x])
+			zeroMeanSum += edgeKernel[y][x]
 		}
 	}
 
 	return &TemplateFromImage{
+		label:          defaultLabel,
 		kernel:         edgeKernel,
 		kernelWidth:    width,
 		kernelHeight:   height,
 		sumKernel:      sumKernel,
+		kernelSum:      zeroMeanSum,
 		originalWidth:  originalWidth,
 		originalHeight: originalHeight,
 		padding:        padding,
 	}, nil
 }
 
+// matchOptions controls how a template is matched against a frame.
+type matchOptions struct {
+	stride    int
+	threshold float32
+	scale     float64
+	backend   correlationBackend
+
+	edgeThreshold int     // Sobel threshold used to build the edge matrix of the image
+	workers       int     // number of goroutines matching templates, GOMAXPROCS if 0
+	nmsIoU        float64 // overlap above which matches are suppressed, defaultNMSIoU if 0
+
+	mode               searchMode
+	pyramidLevels      int     // levels of the pyramid search, defaultPyramidLevels if 0
+	candidateThreshold float32 // coarse correlation refined by the pyramid search, a fraction of threshold if 0
+
+	surface *CorrelationSurface // if set, receives the correlation of every window searched exhaustively
+	best    *bestCorrelation    // if set, receives the best correlation of any window searched
+}
+
+// bestCorrelation is the best correlation of the windows searched by every template, matched or not.
+type bestCorrelation struct {
+	mu    sync.Mutex
+	value float32
+	found bool
+}
+
+// record updates the best correlation with one found by a search.
+func (b *bestCorrelation) record(corr float32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.found || corr > b.value {
+		b.value, b.found = corr, true
+	}
+}
+
+// get returns the best correlation recorded, false if none was.
+func (b *bestCorrelation) get() (float32, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.value, b.found
+}
+
 // FindMatch finds matches of the template in the given image matrix and scales the matches to the original image size
 func (t *TemplateFromImage) FindMatch(image [][]float64, stride int, threshold float32, scale float64) []Match {
-	height := len(image)
-	if height == 0 {
+	if len(image) == 0 {
 		return nil
 	}
-	width := len(image[0])
+	return t.findMatchInFrame(newEdgeFrame(image), matchOptions{stride: stride, threshold: threshold, scale: scale})
+}
+
+// FindMatchWithSurface finds matches of the template like FindMatch, and also records the correlation of
+// every window searched in surface, which must have the size of the image matrix
+func (t *TemplateFromImage) FindMatchWithSurface(image [][]float64, stride int, threshold float32, scale float64,
+	surface *CorrelationSurface,
+) []Match {
+	if len(image) == 0 {
+		return nil
+	}
+	return t.findMatchInFrame(newEdgeFrame(image),
+		matchOptions{stride: stride, threshold: threshold, scale: scale, surface: surface})
+}
+
+// findMatchInFrame finds matches of the template in a prepared frame. The mean and variance of each window
+// come from the frame's summed-area tables, the product with the kernel from the configured backend.
+func (t *TemplateFromImage) findMatchInFrame(frame *edgeFrame, opts matchOptions) []Match {
+	return t.findMatchInRows(frame, opts, 0, frame.height)
+}
+
+// findMatchInRows finds matches of the template whose top row is in [rowStart, rowEnd).
+// rowStart must be a multiple of the stride so bands of rows yield the same windows as the whole frame.
+func (t *TemplateFromImage) findMatchInRows(frame *edgeFrame, opts matchOptions, rowStart, rowEnd int) []Match {
+	if frame.height <= t.kernelHeight || frame.width <= t.kernelWidth {
+		return nil // the template does not fit in the frame
+	}
+	rowEnd = min(rowEnd, frame.height-t.kernelHeight)
+
+	product := t.spatialProduct
+	if opts.backend.useFFT(t) {
+		surface := frame.crossCorrelate(t)
+		product = func(frame *edgeFrame, i, j int) float64 {
+			return surface[i*frame.fftWidth+j]
+		}
+	}
 
 	// Find matches
 	var matches []Match
-	for i := 0; i < height-t.kernelHeight; i += stride {
-		for j := 0; j < width-t.kernelWidth; j += stride {
-			// Calculate crop mean
-			var cropSum float64 = 0
-			for y := 0; y < t.kernelHeight; y++ {
-				for x := 0; x < t.kernelWidth; x++ {
-					cropSum += image[i+y][j+x]
-				}
+	var rowCorrs []float32
+	best, found := float32(0), false
+	for i := rowStart; i < rowEnd; i += opts.stride {
+		rowCorrs = rowCorrs[:0]
+		for j := 0; j < frame.width-t.kernelWidth; j += opts.stride {
+			corr, ok := t.correlationAt(frame, i, j, product(frame, i, j))
+			if ok && corr > opts.threshold {
+				matches = append(matches, t.matchAt(i, j, corr, opts.scale))
 			}
-			cropMean := cropSum / float64(t.kernelHeight*t.kernelWidth)
-
-			sumProduct := 0.0
-			sumCropSquared := 0.0
-
-			for y := 0; y < t.kernelHeight; y++ {
-				for x := 0; x < t.kernelWidth; x++ {
-					normalizedCrop := image[i+y][j+x] - cropMean // mean subtraction from image
-					sumProduct += normalizedCrop * t.kernel[y][x]
-					sumCropSquared += normalizedCrop * normalizedCrop
-				}
+			if ok && (!found || corr > best) {
+				best, found = corr, true
 			}
-
-			// Calculate correlation coefficient
-			denominator := float32(math.Sqrt(float64(float32(sumCropSquared) * t.sumKernel)))
-			if denominator > 0 {
-				corr := float32(sumProduct) / denominator
-				if corr > threshold {
-					matches = append(matches, Match{
-						X:      int(float64(j+t.padding) * 1 / scale),
-						Y:      int(float64(i+t.padding) * 1 / scale),
-						Width:  t.originalWidth,
-						Height: t.originalHeight,
-						Score:  corr,
-					})
+			if opts.surface != nil {
+				if !ok {
+					corr = float32(math.NaN()) // flat window, nothing to record
 				}
+				rowCorrs = append(rowCorrs, corr)
 			}
 		}
+		if opts.surface != nil {
+			// windows are recorded at their center so templates of different sizes line up
+			opts.surface.recordRow(i+t.kernelHeight/2, t.kernelWidth/2, opts.stride, rowCorrs)
+		}
+	}
+	if opts.best != nil && found {
+		opts.best.record(best)
 	}
 
 	return matches
 }
 
+// correlationAt returns the normalized correlation of the template with the window whose top left corner is (j, i),
+// given sum(crop * kernel) for that window. It returns false for flat windows where the correlation is undefined.
+func (t *TemplateFromImage) correlationAt(frame *edgeFrame, i, j int, product float64) (float32, bool) {
+	n := float64(t.kernelHeight * t.kernelWidth)
+	cropSum, cropSqSum := frame.windowSums(j, i, t.kernelWidth, t.kernelHeight)
+	cropMean := cropSum / n
+
+	// sum((crop - mean)^2) = sum(crop^2) - sum(crop)^2 / n
+	sumCropSquared := math.Max(cropSqSum-cropSum*cropMean, 0)
+
+	// sum((crop - mean) * kernel) = sum(crop * kernel) - mean * sum(kernel)
+	sumProduct := product - cropMean*t.kernelSum
+
+	// Calculate correlation coefficient
+	denominator := float32(math.Sqrt(float64(float32(sumCropSquared) * t.sumKernel)))
+	if denominator <= 0 {
+		return 0, false
+	}
+	return float32(sumProduct) / denominator, true
+}
+
+// matchAt returns the match for the window whose top left corner is (j, i), scaled to the original image size.
+func (t *TemplateFromImage) matchAt(i, j int, corr float32, scale float64) Match {
+	return Match{
+		X:      int(float64(j+t.padding) * 1 / scale),
+		Y:      int(float64(i+t.padding) * 1 / scale),
+		Width:  t.originalWidth,
+		Height: t.originalHeight,
+		Score:  corr,
+		Label:  t.label,
+
+		ScaleFactor: t.scaleFactor,
+	}
+}
+
+// spatialProduct computes sum(crop * kernel) for the window whose top left corner is (j, i).
+func (t *TemplateFromImage) spatialProduct(frame *edgeFrame, i, j int) float64 {
+	sumProduct := 0.0
+	for y := 0; y < t.kernelHeight; y++ {
+		row := frame.data[i+y][j : j+t.kernelWidth]
+		kernelRow := t.kernel[y]
+		for x, v := range row {
+			sumProduct += v * kernelRow[x]
+		}
+	}
+	return sumProduct
+}
+
 // Match represents a found match with its position and correlation score
 type Match struct {
 	X      int
@@ -163,6 +300,10 @@ type Match struct {
 	Width  int
 	Height int
 	Score  float32
+	Label  string
+
+	// ScaleFactor is the size of the matched template relative to the image scale
+	ScaleFactor float64
 }
 
 // GetBoundingBox returns the bounding box of the match
@@ -212,7 +353,7 @@ func sobelEdge(gray_img [][]float64, width int, height int, threshold int16) [][
 	return edge
 }
 
-// used for visualizing the edge matrix
+// used for visualizing the edge matrix, negative values (found in mean subtracted kernels) are drawn black
 func EdgeMatrixToGrayImage(edge [][]float64) *image.Gray {
 	height := len(edge)
 	width := len(edge[0])
@@ -224,14 +365,14 @@ func EdgeMatrixToGrayImage(edge [][]float64) *image.Gray {
 				maxVal = edge[y][x] //finding max val for image normalization
 			}
 		}
-		if maxVal == 0 {
-			maxVal = 1
-		}
-		for y := 0; y < height; y++ {
-			for x := 0; x < width; x++ {
-				norm := uint8((edge[y][x] / maxVal) * 255)
-				img.SetGray(x, y, color.Gray{Y: norm})
-			}
+	}
+	if maxVal == 0 {
+		maxVal = 1
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			norm := uint8((math.Max(edge[y][x], 0) / maxVal) * 255)
+			img.SetGray(x, y, color.Gray{Y: norm})
 		}
 	}
 	return img
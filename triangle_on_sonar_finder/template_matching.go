@@ -1,77 +1,100 @@
 package triangle_on_sonar_finder
 
 import (
-	"embed"
+	"context"
 	"fmt"
 	"image"
 	"image/color"
-	"path"
+	"runtime"
 	"sort"
-	"strings"
+	"sync"
 
 	objdet "go.viam.com/rdk/vision/objectdetection"
 )
 
-//go:embed templates/*
-var templateFS embed.FS
+// defaultNMSIoU is the overlap above which the weaker of two matches of the same label is suppressed.
+const defaultNMSIoU = 0.3
 
-// loadTemplates loads template images from the specified directory and returns
-// a slice of TemplateFromImage objects. Each template is normalized. Returns an error if the directory cannot be accessed or if
-// no valid templates are found.
-func loadTemplates(scale float64) ([]TemplateFromImage, error) {
-	validExtensions := []string{".png", ".jpg", ".jpeg"}
+// minTemplateSize is the smallest width or height of a resized template, the Sobel operator needs 3x3 pixels.
+const minTemplateSize = 3
 
-	files, err := templateFS.ReadDir("templates")
-	if err != nil {
-		return nil, fmt.Errorf("error reading template directory: %v", err)
-	}
+// defaultScaleFactors are the sizes, relative to the image scale, at which a copy of each template is made.
+var defaultScaleFactors = []float64{0.75, 1, 1.25}
 
-	templates := []TemplateFromImage{}
+// templateOptions controls how template images are turned into templates.
+type templateOptions struct {
+	scale         float64   // scale the input images are resized by
+	scaleFactors  []float64 // a copy of each template is made at each factor of scale, defaultScaleFactors if empty
+	edgeThreshold int       // Sobel threshold, must match the one used for the input images
+}
 
-	scales := []float64{scale * 0.75, scale, scale * 1.25} // create copies of each template at 75%, 100%, 125% of base scale
+// loadTemplates loads the embedded template images and returns a slice of TemplateFromImage objects.
+func loadTemplates(scale float64) ([]TemplateFromImage, error) {
+	return loadTemplatesFrom([]templateSource{embeddedTemplateSource()}, templateOptions{scale: scale, edgeThreshold: defaultEdgeThreshold})
+}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+// loadTemplatesFrom loads template images from every source in order and returns
+// a slice of TemplateFromImage objects. Each template is normalized. Returns an error if a source cannot be read,
+// if one of its images cannot be decoded, or if two templates have the same name and could not be told apart.
+func loadTemplatesFrom(sources []templateSource, opts templateOptions) ([]TemplateFromImage, error) {
+	templates := []TemplateFromImage{}
+	seen := map[string]templateSource{}
+	for _, source := range sources {
+		images, err := source.readImages()
+		if err != nil {
+			return nil, err
 		}
 
-		filename := file.Name()
-		isValidExt := false
-		for _, ext := range validExtensions {
-			if strings.HasSuffix(strings.ToLower(filename), ext) {
-				isValidExt = true
-				break
+		for _, tmplImg := range images {
+			if other, ok := seen[tmplImg.name]; ok {
+				return nil, fmt.Errorf("template [%s] is in both %s and %s", tmplImg.name, other, source)
+			}
+			seen[tmplImg.name] = source
+			imgTemplates, err := newTemplatesFromImage(tmplImg, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%w in %s", err, source)
 			}
+			templates = append(templates, imgTemplates...)
 		}
+	}
+	return templates, nil
+}
 
-		if !isValidExt {
-			continue
-		}
+// newTemplatesFromImage creates a copy of the template at each scale factor.
+func newTemplatesFromImage(tmplImg templateImage, opts templateOptions) ([]TemplateFromImage, error) {
+	scaleFactors := opts.scaleFactors
+	if len(scaleFactors) == 0 {
+		scaleFactors = defaultScaleFactors
+	}
 
-		f, err := templateFS.Open(path.Join("templates", filename))
-		if err != nil {
-			return nil, fmt.Errorf("cannot open file [%s]: %w", filename, err)
+	templates := make([]TemplateFromImage, 0, len(scaleFactors))
+	for _, factor := range scaleFactors {
+		scale := opts.scale * factor
+		bounds := tmplImg.img.Bounds()
+		if float64(bounds.Dx())*scale < minTemplateSize || float64(bounds.Dy())*scale < minTemplateSize {
+			return nil, fmt.Errorf("template [%s] is smaller than %d pixels at scale %f", tmplImg.name, minTemplateSize, scale)
 		}
-		defer f.Close()
-
-		img, _, err := image.Decode(f)
+		template, err := NewTemplateFromImageWithEdgeThreshold(tmplImg.img, scale, opts.edgeThreshold)
 		if err != nil {
-			return nil, fmt.Errorf("error decoding image (%s): %v", filename, err)
+			return nil, fmt.Errorf("cannot create template from [%s] at scale %f: %w", tmplImg.name, scale, err)
 		}
-
-		for _, scale := range scales {
-			template, err := NewTemplateFromImage(img, scale)
-			if err != nil {
-				return nil, fmt.Errorf("cannot create template from [%s] at scale %f: %w", filename, scale, err)
-			}
-			templates = append(templates, *template)
+		template.name = tmplImg.name
+		template.scaleFactor = factor
+		if tmplImg.label != "" {
+			template.label = tmplImg.label
 		}
+		templates = append(templates, *template)
 	}
 	return templates, nil
 }
 
 // ImageToMatrix converts a grayscale image to a 2D float32 matrix -- preprocessing image using sobel edge detection and resizing
 func ImageToMatrix(img image.Image, scale float64) [][]float64 {
+	return ImageToMatrixWithEdgeThreshold(img, scale, defaultEdgeThreshold)
+}
+
+// ImageToMatrixWithEdgeThreshold converts an image to an edge matrix, dropping edges weaker than edgeThreshold
+func ImageToMatrixWithEdgeThreshold(img image.Image, scale float64, edgeThreshold int) [][]float64 {
 	originalWidth := img.Bounds().Dx()
 	// step 1: resize image
 	img = resizeImage(img, uint(float64(originalWidth)*scale)) //resizing image
@@ -91,7 +114,7 @@ func ImageToMatrix(img image.Image, scale float64) [][]float64 {
 	}
 
 	// step 3: apply Sobel edge detection
-	edgeMatrix := sobelEdge(grayMatrix, newWidth, newHeight, 50) // adjust threshold as needed
+	edgeMatrix := sobelEdge(grayMatrix, newWidth, newHeight, int16(edgeThreshold))
 	// step 4: return the edge matrix [][]float64
 	return edgeMatrix
 }
@@ -119,54 +142,172 @@ func calculateIoU(box1, box2 *image.Rectangle) float64 {
 }
 
 func findTriangles(templates []TemplateFromImage, imgMatrix [][]float64, stride int, threshold float32, scale float64) []objdet.Detection {
-	// Find matches using all templates
+	detections, _ := detectTriangles(context.Background(), templates, imgMatrix,
+		matchOptions{stride: stride, threshold: threshold, scale: scale})
+	return detections
+}
+
+// matchJob is the part of the search done by one worker: one template, or one template over a band of rows.
+type matchJob func() []Match
+
+// splitMatchJobs splits the search into one job per template, and splits templates into bands of rows
+// when there are fewer templates than workers so every worker has something to do.
+func splitMatchJobs(templates []TemplateFromImage, frame *edgeFrame, opts matchOptions, workers int) []matchJob {
+	var jobs []matchJob
+	if opts.mode == searchPyramid {
+		levels := opts.pyramidLevels
+		if levels <= 0 {
+			levels = defaultPyramidLevels
+		}
+		pyramid := buildPyramid(frame, levels)
+		for i := range templates {
+			template := &templates[i]
+			jobs = append(jobs, func() []Match { return template.findMatchPyramid(pyramid, opts) })
+		}
+		return jobs
+	}
+
+	bands := 1
+	if len(templates) > 0 && len(templates) < workers {
+		bands = (workers + len(templates) - 1) / len(templates)
+	}
+
+	for i := range templates {
+		template := &templates[i]
+		templateBands := bands
+		if opts.backend.useFFT(template) {
+			templateBands = 1 // the correlation surface is computed for the whole frame anyway
+		}
+		// bands start on a multiple of the stride so they cover the same windows as a single pass
+		rows := frame.height - template.kernelHeight
+		bandHeight := (rows + templateBands - 1) / templateBands
+		bandHeight = max((bandHeight+opts.stride-1)/opts.stride*opts.stride, opts.stride)
+		for rowStart := 0; rowStart < max(rows, 1); rowStart += bandHeight {
+			jobs = append(jobs, func() []Match {
+				return template.findMatchInRows(frame, opts, rowStart, rowStart+bandHeight)
+			})
+		}
+	}
+	return jobs
+}
+
+// matchTemplates matches every template against the frame using a pool of workers. Matches are returned
+// in template then row order regardless of how the jobs were scheduled.
+func matchTemplates(ctx context.Context, templates []TemplateFromImage, frame *edgeFrame, opts matchOptions) ([]Match, error) {
+	workers := opts.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := splitMatchJobs(templates, frame, opts, workers)
+	results := make([][]Match, len(jobs))
+
+	jobIndexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobIndexes {
+				if ctx.Err() != nil {
+					continue
+				}
+				results[i] = jobs[i]()
+			}
+		}()
+	}
+	for i := range jobs {
+		jobIndexes <- i
+	}
+	close(jobIndexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var allMatches []Match
-	for _, template := range templates {
-		matches := template.FindMatch(imgMatrix, stride, threshold, scale)
+	for _, matches := range results {
 		allMatches = append(allMatches, matches...)
 	}
+	return allMatches, nil
+}
+
+// detectTriangles matches every template against the edge matrix and returns the detections left after
+// non-maximum suppression.
+func detectTriangles(ctx context.Context, templates []TemplateFromImage, imgMatrix [][]float64, opts matchOptions) ([]objdet.Detection, error) {
+	matches, err := detectMatches(ctx, templates, imgMatrix, opts)
+	if err != nil {
+		return nil, err
+	}
+	return matchesToDetections(matches), nil
+}
 
-	// Convert matches to detections
-	detections := make([]objdet.Detection, 0, len(allMatches))
-	for _, match := range allMatches {
-		box := match.GetBoundingBox() // adding padding to the bounding box
-		det := objdet.NewDetectionWithoutImgBounds(box, float64(match.Score), "triangle")
-		detections = append(detections, det)
+// detectMatches matches every template against the edge matrix and returns the matches left after
+// non-maximum suppression, best first.
+func detectMatches(ctx context.Context, templates []TemplateFromImage, imgMatrix [][]float64, opts matchOptions) ([]Match, error) {
+	if len(imgMatrix) == 0 {
+		return nil, nil
 	}
 
-	// Sort detections by score in descending order
-	sort.Slice(detections, func(i, j int) bool {
-		return detections[i].Score() > detections[j].Score()
+	// Find matches using all templates, sharing the summed-area tables of the frame
+	allMatches, err := matchTemplates(ctx, templates, newEdgeFrame(imgMatrix), opts)
+	if err != nil {
+		return nil, err
+	}
+	nmsIoU := opts.nmsIoU
+	if nmsIoU <= 0 {
+		nmsIoU = defaultNMSIoU
+	}
+	return nonMaxSuppression(allMatches, nmsIoU), nil
+}
+
+// nonMaxSuppression keeps the best of the matches of the same label that overlap by more than iouThreshold.
+func nonMaxSuppression(matches []Match, iouThreshold float64) []Match {
+	// Sort matches by score in descending order, keeping the match order for equal scores
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
 	})
 
-	// Apply Non-Maximum Suppression
-	var filteredDetections []objdet.Detection
-	used := make([]bool, len(detections))
+	// Apply Non-Maximum Suppression, per class so overlapping markers of different shapes are all kept
+	var filteredMatches []Match
+	used := make([]bool, len(matches))
 
-	for i := 0; i < len(detections); i++ {
+	for i := 0; i < len(matches); i++ {
 		if used[i] {
 			continue
 		}
 
-		// Keep the current detection
-		filteredDetections = append(filteredDetections, detections[i])
+		// Keep the current match
+		filteredMatches = append(filteredMatches, matches[i])
 		used[i] = true
+		box := matches[i].GetBoundingBox()
 
-		// Check overlap with remaining detections
-		for j := i + 1; j < len(detections); j++ {
-			if used[j] {
+		// Check overlap with remaining matches
+		for j := i + 1; j < len(matches); j++ {
+			if used[j] || matches[j].Label != matches[i].Label {
 				continue
 			}
 
-			// Calculate IoU between current and remaining detection
-			iou := calculateIoU(detections[i].BoundingBox(), detections[j].BoundingBox())
+			// Calculate IoU between current and remaining match
+			other := matches[j].GetBoundingBox()
+			iou := calculateIoU(&box, &other)
 
 			// If IoU is greater than threshold, mark as used
-			if iou > 0.3 { // You can adjust this threshold
+			if iou > iouThreshold {
 				used[j] = true
 			}
 		}
 	}
 
-	return filteredDetections
+	return filteredMatches
+}
+
+// matchesToDetections converts matches to detections in the original image coordinates.
+func matchesToDetections(matches []Match) []objdet.Detection {
+	detections := make([]objdet.Detection, 0, len(matches))
+	for _, match := range matches {
+		box := match.GetBoundingBox()
+		detections = append(detections, objdet.NewDetectionWithoutImgBounds(box, float64(match.Score), match.Label))
+	}
+	return detections
 }
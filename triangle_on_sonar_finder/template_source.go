@@ -0,0 +1,144 @@
+package triangle_on_sonar_finder
+
+import (
+	"embed"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	// register decoders for the template formats we accept
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+//go:embed templates/*
+var templateFS embed.FS
+
+var validTemplateExtensions = []string{".png", ".jpg", ".jpeg"}
+
+// templateImage is a decoded template image along with the name of the file it was read from
+// and the class label of the marker it shows.
+type templateImage struct {
+	name  string
+	label string
+	img   image.Image
+}
+
+// templateSource is somewhere template images can be read from (the embedded templates, a directory on disk...).
+type templateSource interface {
+	// String describes the source, used in error messages.
+	String() string
+	// readImages returns every template image found in the source.
+	readImages() ([]templateImage, error)
+}
+
+// fsTemplateSource reads template images from the files under a root of a fs.FS. Files in a
+// subdirectory are labelled with the name of that subdirectory, files at the root are labelled after their name.
+type fsTemplateSource struct {
+	description string
+	fsys        fs.FS
+	root        string
+}
+
+// embeddedPrefix starts the name of the embedded templates when they are merged with a templates directory,
+// so their ids never clash with the templates of the directory.
+const embeddedPrefix = "embedded/"
+
+// prefixedTemplateSource names the templates of a source with a prefix, to tell them from templates of other
+// sources with the same file name. Labels are still derived from the names in the source.
+type prefixedTemplateSource struct {
+	templateSource
+	prefix string
+}
+
+func (s *prefixedTemplateSource) readImages() ([]templateImage, error) {
+	images, err := s.templateSource.readImages()
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].name = s.prefix + images[i].name
+	}
+	return images, nil
+}
+
+// embeddedTemplateSource returns the templates compiled into the module binary.
+func embeddedTemplateSource() templateSource {
+	return &fsTemplateSource{description: "embedded templates", fsys: templateFS, root: "templates"}
+}
+
+// directoryTemplateSource returns the templates found in a directory on disk.
+func directoryTemplateSource(dir string) templateSource {
+	return &fsTemplateSource{description: fmt.Sprintf("template directory %q", dir), fsys: os.DirFS(dir), root: "."}
+}
+
+func (s *fsTemplateSource) String() string {
+	return s.description
+}
+
+func (s *fsTemplateSource) readImages() ([]templateImage, error) {
+	images := []templateImage{}
+	err := fs.WalkDir(s.fsys, s.root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w", s, err)
+		}
+		if entry.IsDir() || !isTemplateFile(name) {
+			return nil
+		}
+		img, err := s.decode(name)
+		if err != nil {
+			return err
+		}
+		relName := strings.TrimPrefix(name, s.root+"/")
+		images = append(images, templateImage{name: relName, label: labelFromTemplateName(relName), img: img})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (s *fsTemplateSource) decode(name string) (image.Image, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open [%s] in %s: %w", name, s, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image [%s] in %s: %w", name, s, err)
+	}
+	return img, nil
+}
+
+// labelFromTemplateName derives the class label of a template from its path relative to the source root:
+// "diamond/a.png" is labelled "diamond" and "triangle_1.png" is labelled "triangle".
+func labelFromTemplateName(name string) string {
+	if dir, _, found := strings.Cut(name, "/"); found {
+		return dir
+	}
+	base := strings.TrimSuffix(name, path.Ext(name))
+	if i := strings.LastIndexAny(base, "_-"); i > 0 {
+		if _, err := strconv.Atoi(base[i+1:]); err == nil {
+			base = base[:i]
+		}
+	}
+	return base
+}
+
+// isTemplateFile returns true if the file has one of the supported image extensions.
+func isTemplateFile(filename string) bool {
+	lower := strings.ToLower(filename)
+	for _, ext := range validTemplateExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
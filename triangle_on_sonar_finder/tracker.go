@@ -0,0 +1,286 @@
+package triangle_on_sonar_finder
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	objdet "go.viam.com/rdk/vision/objectdetection"
+)
+
+// defaultTrackMaxMissedFrames is the number of frames a track is kept without being detected.
+const defaultTrackMaxMissedFrames = 5
+
+// track is a triangle followed from frame to frame.
+type track struct {
+	id        int
+	label     string
+	box       image.Rectangle // last detected bounding box
+	score     float32
+	hits      int // number of frames the triangle was detected in
+	missed    int // number of consecutive frames the triangle was not detected in
+	firstSeen time.Time
+	lastSeen  time.Time
+	filter    *motionFilter // smoothed motion of the triangle, nil if the Kalman filter is disabled
+	history   uint64        // bit i is set if the triangle was detected i frames ago
+	confirmed bool          // set once the track was detected in enough frames to be returned
+}
+
+// center returns the center of the last detected bounding box.
+func (t *track) center() (float64, float64) {
+	return float64(t.box.Min.X+t.box.Max.X) / 2, float64(t.box.Min.Y+t.box.Max.Y) / 2
+}
+
+// expectedCenter returns where the triangle is expected in the current frame: the position predicted by
+// its motion filter, or the center of its last detection without a filter.
+func (t *track) expectedCenter() (float64, float64) {
+	if t.filter != nil {
+		return t.filter.x.pos, t.filter.y.pos
+	}
+	return t.center()
+}
+
+// trackerOptions controls how detections are associated with tracks.
+type trackerOptions struct {
+	maxDistance     float64          // largest center distance, in pixels, a track can move between frames, its size if 0
+	maxMissedFrames int              // frames a lost track is kept for
+	kalman          *kalmanOptions   // smooths the motion of the tracks if set
+	debounce        *debounceOptions // only returns confirmed tracks if set
+}
+
+// tracker associates the detections of successive frames of a camera so each triangle keeps the same id.
+type tracker struct {
+	opts   trackerOptions
+	tracks []*track
+	nextID int
+}
+
+func newTracker(opts trackerOptions) *tracker {
+	if opts.maxMissedFrames <= 0 {
+		opts.maxMissedFrames = defaultTrackMaxMissedFrames
+	}
+	if opts.kalman != nil {
+		kalman := opts.kalman.withDefaults()
+		opts.kalman = &kalman
+	}
+	if opts.debounce != nil {
+		// held tracks must be kept to be returned
+		opts.maxMissedFrames = max(opts.maxMissedFrames, opts.debounce.holdFrames)
+	}
+	return &tracker{opts: opts, nextID: 1}
+}
+
+// update associates the matches of a new frame with the tracks, greedily pairing the closest match and track
+// of the same label. Matches without a track start a new one, tracks missed for too many frames are dropped.
+// It returns the track of each match.
+func (tr *tracker) update(matches []Match, capturedAt time.Time) []*track {
+	for _, t := range tr.tracks {
+		t.history <<= 1
+		if tr.opts.kalman != nil {
+			t.filter.predict(capturedAt, *tr.opts.kalman)
+		}
+	}
+
+	type pair struct {
+		match, track int
+		distance     float64
+	}
+	var pairs []pair
+	for m := range matches {
+		box := matches[m].GetBoundingBox()
+		mx, my := float64(box.Min.X+box.Max.X)/2, float64(box.Min.Y+box.Max.Y)/2
+		for k, t := range tr.tracks {
+			if t.label != matches[m].Label {
+				continue
+			}
+			tx, ty := t.expectedCenter()
+			distance := math.Hypot(mx-tx, my-ty)
+			maxDistance := tr.opts.maxDistance
+			if maxDistance <= 0 {
+				maxDistance = float64(max(t.box.Dx(), t.box.Dy()))
+			}
+			if distance <= maxDistance || calculateIoU(&box, &t.box) > 0 {
+				pairs = append(pairs, pair{match: m, track: k, distance: distance})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].distance < pairs[j].distance })
+
+	assigned := make([]*track, len(matches))
+	updated := make([]bool, len(tr.tracks))
+	for _, p := range pairs {
+		if assigned[p.match] != nil || updated[p.track] {
+			continue
+		}
+		t := tr.tracks[p.track]
+		t.box = matches[p.match].GetBoundingBox()
+		t.score = matches[p.match].Score
+		t.hits++
+		t.missed = 0
+		t.lastSeen = capturedAt
+		t.history |= 1
+		if t.filter != nil {
+			x, y := t.center()
+			t.filter.update(x, y, capturedAt, *tr.opts.kalman)
+		}
+		assigned[p.match] = t
+		updated[p.track] = true
+	}
+
+	kept := tr.tracks[:0]
+	for k, t := range tr.tracks {
+		if !updated[k] {
+			t.missed++
+		}
+		if t.missed <= tr.opts.maxMissedFrames {
+			kept = append(kept, t)
+		}
+	}
+	tr.tracks = kept
+
+	for m, match := range matches {
+		if assigned[m] != nil {
+			continue
+		}
+		t := &track{
+			id:        tr.nextID,
+			label:     match.Label,
+			box:       match.GetBoundingBox(),
+			score:     match.Score,
+			hits:      1,
+			firstSeen: capturedAt,
+			lastSeen:  capturedAt,
+			history:   1,
+		}
+		if tr.opts.kalman != nil {
+			x, y := t.center()
+			t.filter = newMotionFilter(x, y, capturedAt, *tr.opts.kalman)
+		}
+		tr.nextID++
+		tr.tracks = append(tr.tracks, t)
+		assigned[m] = t
+	}
+
+	if tr.opts.debounce != nil {
+		for _, t := range tr.tracks {
+			t.confirmed = t.confirmed || tr.opts.debounce.confirms(t.history)
+		}
+	}
+	return assigned
+}
+
+// trackerOptions returns the tracking options of the config.
+func (cfg *TriangleFinderConfig) trackerOptions() trackerOptions {
+	opts := trackerOptions{maxDistance: cfg.TrackMaxDistance, maxMissedFrames: cfg.TrackMaxMissedFrames}
+	if cfg.KalmanFilter {
+		opts.kalman = &kalmanOptions{processNoise: cfg.KalmanProcessNoise, measurementNoise: cfg.KalmanMeasurementNoise}
+	}
+	opts.debounce = cfg.debounceOptions()
+	return opts
+}
+
+// trackMatches feeds the matches of a new frame of the camera to its tracker, if tracking is enabled,
+// and returns the matches to report with the id of the track of each. Unless debouncing is enabled,
+// these are the given matches.
+func (tf *myTriangleFinder) trackMatches(cameraName string, matches []Match, capturedAt time.Time) ([]Match, []int) {
+	tf.mu.RLock()
+	cfg := tf.config
+	tf.mu.RUnlock()
+	if !cfg.Tracking {
+		return matches, nil
+	}
+
+	tf.trackMu.Lock()
+	defer tf.trackMu.Unlock()
+	tr, ok := tf.trackers[cameraName]
+	if !ok {
+		tr = newTracker(cfg.trackerOptions())
+		tf.trackers[cameraName] = tr
+	}
+	assigned := tr.update(matches, capturedAt)
+	if tr.opts.debounce != nil {
+		return tr.debounced(matches, assigned)
+	}
+	ids := make([]int, len(matches))
+	for i, t := range assigned {
+		ids[i] = t.id
+	}
+	return matches, ids
+}
+
+// resetTrackers forgets every track, when the cameras or the settings change.
+func (tf *myTriangleFinder) resetTrackers() {
+	tf.trackMu.Lock()
+	defer tf.trackMu.Unlock()
+	tf.trackers = map[string]*tracker{}
+}
+
+// detections returns the detections of the result, with the track id appended to their label if asked to.
+func (r *frameResult) detections(idsInLabels bool) []objdet.Detection {
+	detections := matchesToDetections(r.matches)
+	if !idsInLabels || len(r.trackIDs) != len(detections) {
+		return detections
+	}
+	for i, det := range detections {
+		label := fmt.Sprintf("%s#%d", det.Label(), r.trackIDs[i])
+		detections[i] = objdet.NewDetectionWithoutImgBounds(*det.BoundingBox(), det.Score(), label)
+	}
+	return detections
+}
+
+// tracks returns the current tracks of a camera, each with its id, label, last position and size,
+// score and how many frames it was seen and missed, its smoothed motion if the Kalman filter is enabled,
+// whether it is confirmed if debouncing is enabled, and the range and bearing of its expected position if
+// the sonar is calibrated.
+// Tracks are updated once by each frame of the camera that is searched.
+func (tf *myTriangleFinder) tracks(cmd map[string]interface{}) (map[string]interface{}, error) {
+	cameraName, err := cameraNameParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	cameraName, cfg := tf.cameraConfig(cameraName)
+	sonar := cfg.SonarCalibrations[cameraName]
+	if !cfg.Tracking {
+		return nil, errors.New("tracking is not enabled")
+	}
+	if _, err := tf.getCamera(cameraName); err != nil {
+		return nil, err
+	}
+
+	tf.trackMu.Lock()
+	defer tf.trackMu.Unlock()
+	list := []interface{}{}
+	if tr, ok := tf.trackers[cameraName]; ok {
+		for _, t := range tr.tracks {
+			x, y := t.center()
+			entry := map[string]interface{}{
+				"id":            t.id,
+				"label":         t.label,
+				"x_center":      x,
+				"y_center":      y,
+				"width":         t.box.Dx(),
+				"height":        t.box.Dy(),
+				"score":         float64(t.score),
+				"hits":          t.hits,
+				"missed_frames": t.missed,
+				"first_seen":    t.firstSeen.Format(time.RFC3339Nano),
+				"last_seen":     t.lastSeen.Format(time.RFC3339Nano),
+			}
+			if t.filter != nil {
+				entry["smoothed"] = t.filter.readings()
+			}
+			if tr.opts.debounce != nil {
+				entry["confirmed"] = t.confirmed
+			}
+			if sonar != nil {
+				sx, sy := t.expectedCenter()
+				sonar.addPolarReadings(entry, sx, sy)
+			}
+			list = append(list, entry)
+		}
+	}
+	return map[string]interface{}{"tracks": list}, nil
+}
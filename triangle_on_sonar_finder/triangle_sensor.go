@@ -0,0 +1,140 @@
+package triangle_on_sonar_finder
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/vision"
+	objdet "go.viam.com/rdk/vision/objectdetection"
+)
+
+const (
+	SensorModelName = "triangle-sensor"
+)
+
+var SensorModel = resource.NewModel("viam", "sensor", SensorModelName)
+
+func init() {
+	resource.RegisterComponent(sensor.API, SensorModel, resource.Registration[sensor.Sensor, *TriangleSensorConfig]{
+		Constructor: newTriangleSensor,
+	})
+}
+
+// TriangleSensorConfig contains the configuration for the sensor reporting the detections of a triangle finder.
+type TriangleSensorConfig struct {
+	// VisionService is the name of the triangle finder (or any vision service) whose detections are reported.
+	VisionService string `json:"vision_service"`
+
+	// Camera is the name of the camera to detect triangles in, the default camera of the vision service if not set.
+	Camera string `json:"camera_name,omitempty"`
+}
+
+// Validate checks the config and returns the vision service as a dependency.
+func (cfg TriangleSensorConfig) Validate(path string) ([]string, error) {
+	if cfg.VisionService == "" {
+		return nil, resource.NewConfigValidationFieldRequiredError(path, "vision_service")
+	}
+	return []string{cfg.VisionService}, nil
+}
+
+// triangleSensor reports the number and positions of the triangles detected by a vision service as readings,
+// so they can be captured by the data manager.
+type triangleSensor struct {
+	resource.AlwaysRebuild
+
+	name       resource.Name
+	logger     logging.Logger
+	finder     vision.Service
+	cameraName string
+}
+
+func newTriangleSensor(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (sensor.Sensor, error) {
+	sensorConf, err := resource.NativeConfig[*TriangleSensorConfig](conf)
+	if err != nil {
+		return nil, errors.Errorf("failed to parse config for %s got: %s", SensorModelName, err)
+	}
+	finder, err := vision.FromDependencies(deps, sensorConf.VisionService)
+	if err != nil {
+		return nil, errors.Errorf("failed to get vision service from dependencies for %s got: %s", SensorModelName, err)
+	}
+	return &triangleSensor{name: conf.ResourceName(), logger: logger, finder: finder, cameraName: sensorConf.Camera}, nil
+}
+
+func (ts *triangleSensor) Name() resource.Name {
+	return ts.name
+}
+
+// Readings returns the number of detections, the best score, and the label, score, center and size of each
+// detection in image pixels, with its range and bearing if the vision service has a sonar calibration for the camera.
+func (ts *triangleSensor) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	detections, err := ts.finder.DetectionsFromCamera(ctx, ts.cameraName, extra)
+	if err != nil {
+		return nil, errors.Errorf("failed to get detections for %s got: %s", SensorModelName, err)
+	}
+	return detectionReadings(detections, ts.sonarCalibration(ctx)), nil
+}
+
+// sonarCalibration returns the sonar calibration of the camera from the get_sonar_calibration command of the
+// vision service, nil if the camera is not calibrated or the service is not a triangle finder. It is asked at
+// every reading since reconfiguring the finder can change it.
+func (ts *triangleSensor) sonarCalibration(ctx context.Context) *SonarCalibration {
+	cmd := map[string]interface{}{"command": getSonarCalibrationCommand}
+	if ts.cameraName != "" {
+		cmd["camera_name"] = ts.cameraName
+	}
+	res, err := ts.finder.DoCommand(ctx, cmd)
+	if err != nil {
+		ts.logger.Debugf("no sonar calibration from the vision service: %s", err)
+		return nil
+	}
+	attributes, ok := res["sonar_calibration"]
+	if !ok {
+		return nil
+	}
+	sonar, err := sonarCalibrationFromAttributes(attributes)
+	if err != nil {
+		ts.logger.Warnf("ignoring the sonar calibration of the vision service: %s", err)
+		return nil
+	}
+	return sonar
+}
+
+// detectionReadings summarizes detections as sensor readings, with the range and bearing of their centers
+// if a sonar calibration is given.
+func detectionReadings(detections []objdet.Detection, sonar *SonarCalibration) map[string]interface{} {
+	bestScore := 0.0
+	list := make([]interface{}, 0, len(detections))
+	for _, det := range detections {
+		box := det.BoundingBox()
+		bestScore = max(bestScore, det.Score())
+		x, y := float64(box.Min.X+box.Max.X)/2, float64(box.Min.Y+box.Max.Y)/2
+		reading := map[string]interface{}{
+			"label":    det.Label(),
+			"score":    det.Score(),
+			"x_center": x,
+			"y_center": y,
+			"width":    box.Dx(),
+			"height":   box.Dy(),
+		}
+		if sonar != nil {
+			sonar.addPolarReadings(reading, x, y)
+		}
+		list = append(list, reading)
+	}
+	return map[string]interface{}{
+		"count":      len(detections),
+		"best_score": bestScore,
+		"detections": list,
+	}
+}
+
+func (ts *triangleSensor) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	return nil, errUnimplemented
+}
+
+func (ts *triangleSensor) Close(ctx context.Context) error {
+	return nil
+}
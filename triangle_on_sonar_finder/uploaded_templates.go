@@ -0,0 +1,293 @@
+package triangle_on_sonar_finder
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// uploadedPrefix starts the name of uploaded templates, so their ids never clash with configured templates.
+const uploadedPrefix = "uploaded/"
+
+// readUploadedTemplates returns the templates saved in the uploaded templates directory, none if it does not exist yet.
+func readUploadedTemplates(dir string) ([]templateImage, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	images, err := directoryTemplateSource(dir).readImages()
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].name = uploadedPrefix + images[i].name
+	}
+	return images, nil
+}
+
+// decodeBase64Image decodes a base64 png or jpeg image, with or without a data URL prefix.
+func decodeBase64Image(encoded string) (image.Image, error) {
+	if _, data, found := strings.Cut(encoded, ";base64,"); found {
+		encoded = data
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "image is not valid base64")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode image")
+	}
+	return img, nil
+}
+
+// encodeBase64PNG encodes an image as a base64 png, to be returned by a command.
+func encodeBase64PNG(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", errors.Wrap(err, "cannot encode image")
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// cropImage returns a copy of the rect region of img, rect being relative to the top left corner of img.
+func cropImage(img image.Image, rect image.Rectangle) (image.Image, error) {
+	bounds := img.Bounds()
+	rect = rect.Add(bounds.Min)
+	if !rect.In(bounds) {
+		return nil, errors.Errorf("crop %v is outside of the %dx%d image", rect.Sub(bounds.Min), bounds.Dx(), bounds.Dy())
+	}
+	cropped := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+	return cropped, nil
+}
+
+// uploadTemplate adds a template from a base64 image, optionally cropped and labelled. It is built at every
+// template scale, and saved to the uploaded templates directory if one is configured.
+func (tf *myTriangleFinder) uploadTemplate(cmd map[string]interface{}) (map[string]interface{}, error) {
+	encoded, err := stringParam("image", cmd["image"])
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeBase64Image(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if crop, ok := cmd["crop"]; ok {
+		rect, err := rectParam("crop", crop)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = cropImage(img, rect); err != nil {
+			return nil, err
+		}
+	}
+	label, err := labelParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return tf.addTemplate(img, label)
+}
+
+// templateFromCamera crops a region of the current frame of a camera into a new template, and returns a preview
+// of its edge kernel at the image scale so it can be checked. With "dry_run" the template is previewed but not added.
+func (tf *myTriangleFinder) templateFromCamera(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	cameraName, err := cameraNameParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	rect, err := rectParam("crop", cmd["crop"])
+	if err != nil {
+		return nil, err
+	}
+	label, err := labelParam(cmd)
+	if err != nil {
+		return nil, err
+	}
+	dryRun, err := boolParam(cmd, "dry_run")
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := tf.imageFromCamera(ctx, cameraName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get image from camera")
+	}
+	img, err := cropImage(frame, rect)
+	if err != nil {
+		return nil, err
+	}
+
+	tf.mu.RLock()
+	opts := tf.opts
+	tf.mu.RUnlock()
+	preview, err := newTemplatesFromImage(templateImage{name: "crop", img: img},
+		templateOptions{scale: opts.scale, scaleFactors: []float64{1}, edgeThreshold: opts.edgeThreshold})
+	if err != nil {
+		return nil, err
+	}
+	encodedPreview, err := encodeBase64PNG(EdgeMatrixToGrayImage(preview[0].kernel))
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{}
+	if !dryRun {
+		if res, err = tf.addTemplate(img, label); err != nil {
+			return nil, err
+		}
+	}
+	res["added"] = !dryRun
+	res["preview"] = encodedPreview
+	res["preview_mime_type"] = "image/png"
+	return res, nil
+}
+
+// labelParam returns the "label" parameter of a command, defaultLabel if not set.
+func labelParam(cmd map[string]interface{}) (string, error) {
+	value, ok := cmd["label"]
+	if !ok {
+		return defaultLabel, nil
+	}
+	return stringParam("label", value)
+}
+
+// addTemplate builds the image at every template scale and adds it to the matched templates.
+func (tf *myTriangleFinder) addTemplate(img image.Image, label string) (map[string]interface{}, error) {
+	if label == "" || strings.ContainsAny(label, `/\`) {
+		return nil, errors.Errorf("label must be a non empty name without slashes, got %q", label)
+	}
+
+	tf.updateMu.Lock()
+	defer tf.updateMu.Unlock()
+
+	tf.mu.RLock()
+	cfg, templates := tf.config, tf.templates
+	tf.mu.RUnlock()
+
+	// saved as <label>_<n>.png so the label is found again when the file is loaded
+	fileName := ""
+	for n := 1; fileName == ""; n++ {
+		candidate := fmt.Sprintf("%s_%d.png", label, n)
+		if !slices.ContainsFunc(tf.uploaded, func(upload templateImage) bool { return upload.name == uploadedPrefix+candidate }) {
+			fileName = candidate
+		}
+	}
+	upload := templateImage{name: uploadedPrefix + fileName, label: label, img: img}
+
+	newTemplates, err := newTemplatesFromImage(upload, cfg.templateBuildOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	if dir := cfg.UploadedTemplatesDirectory; dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "cannot create uploaded_templates_directory")
+		}
+		if err := SaveImageAsPNG(img, filepath.Join(dir, fileName)); err != nil {
+			return nil, errors.Wrapf(err, "cannot save template %s", upload.name)
+		}
+	}
+
+	tf.uploaded = append(slices.Clip(tf.uploaded), upload)
+	tf.mu.Lock()
+	tf.templates = append(slices.Clip(templates), newTemplates...)
+	tf.mu.Unlock()
+
+	return templateInfo(newTemplates), nil
+}
+
+// listTemplates returns the templates currently matched, one entry per template image with its size at each scale.
+func (tf *myTriangleFinder) listTemplates() map[string]interface{} {
+	tf.mu.RLock()
+	templates := tf.templates
+	tf.mu.RUnlock()
+
+	list := []interface{}{}
+	for start := 0; start < len(templates); {
+		end := start + 1
+		for end < len(templates) && templates[end].name == templates[start].name {
+			end++
+		}
+		list = append(list, templateInfo(templates[start:end]))
+		start = end
+	}
+	return map[string]interface{}{"templates": list}
+}
+
+// templateInfo describes the copies, at each scale, of a template image.
+func templateInfo(templates []TemplateFromImage) map[string]interface{} {
+	scales := make([]interface{}, 0, len(templates))
+	for _, template := range templates {
+		scales = append(scales, map[string]interface{}{
+			"scale_factor": template.scaleFactor,
+			"width":        template.kernelWidth,
+			"height":       template.kernelHeight,
+		})
+	}
+	first := templates[0]
+	return map[string]interface{}{
+		"id":       first.name,
+		"label":    first.label,
+		"uploaded": strings.HasPrefix(first.name, uploadedPrefix),
+		"width":    first.originalWidth,
+		"height":   first.originalHeight,
+		"scales":   scales,
+	}
+}
+
+// deleteTemplate removes the template with the given id. Uploaded templates are also deleted from the uploaded
+// templates directory, configured templates are left out until the service restarts or a reconfiguration
+// rebuilds the templates.
+func (tf *myTriangleFinder) deleteTemplate(cmd map[string]interface{}) (map[string]interface{}, error) {
+	id, err := stringParam("id", cmd["id"])
+	if err != nil {
+		return nil, err
+	}
+
+	tf.updateMu.Lock()
+	defer tf.updateMu.Unlock()
+
+	tf.mu.RLock()
+	cfg, templates := tf.config, tf.templates
+	tf.mu.RUnlock()
+
+	kept := make([]TemplateFromImage, 0, len(templates))
+	for _, template := range templates {
+		if template.name != id {
+			kept = append(kept, template)
+		}
+	}
+	if len(kept) == len(templates) {
+		return nil, errors.Errorf("unknown template %q", id)
+	}
+	if len(kept) == 0 {
+		return nil, errors.Errorf("cannot delete %q, it is the last template", id)
+	}
+
+	if strings.HasPrefix(id, uploadedPrefix) {
+		if dir := cfg.UploadedTemplatesDirectory; dir != "" {
+			err := os.Remove(filepath.Join(dir, strings.TrimPrefix(id, uploadedPrefix)))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "cannot delete template %s", id)
+			}
+		}
+		tf.uploaded = slices.DeleteFunc(slices.Clone(tf.uploaded), func(upload templateImage) bool { return upload.name == id })
+	} else {
+		tf.removed[id] = true
+	}
+
+	tf.mu.Lock()
+	tf.templates = kept
+	tf.mu.Unlock()
+	return map[string]interface{}{"deleted": id, "templates": len(kept)}, nil
+}